@@ -0,0 +1,170 @@
+package kinesis
+
+import (
+	"crypto/md5"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// aggregatedMagic prefixes the records aggregated with the Kinesis Producer
+// Library format, so the consumers can de-aggregate them.
+var aggregatedMagic = []byte{0xF3, 0x89, 0x9A, 0xC2}
+
+// Protobuf field numbers of the KPL AggregatedRecord and Record messages.
+// We don't set explicit hash keys, so their table is always left empty.
+const (
+	aggPartitionKeyTableField = 1
+	aggRecordsField           = 3
+
+	recPartitionKeyIndexField = 1
+	recDataField              = 3
+)
+
+// aggregator packs many user records into a single Kinesis record, following
+// the KPL aggregated record format: the magic bytes, the AggregatedRecord
+// protobuf message and the MD5 digest of the message.
+type aggregator struct {
+	pKeys     []string
+	pKeyIndex map[string]int
+	records   [][]byte
+	protoSize int
+}
+
+func newAggregator() *aggregator {
+	a := &aggregator{}
+	a.reset()
+	return a
+}
+
+// sizeWith returns the size of the aggregated Kinesis record, data and
+// partition key, if the entry was added to it.
+func (a *aggregator) sizeWith(e *kinesis.PutRecordsRequestEntry) int {
+	protoSize := a.protoSize
+	pKey := *e.PartitionKey
+
+	idx, ok := a.pKeyIndex[pKey]
+	if !ok {
+		idx = len(a.pKeys)
+		protoSize += bytesFieldSize(aggPartitionKeyTableField, len(pKey))
+	}
+	protoSize += bytesFieldSize(aggRecordsField, userRecordSize(idx, len(e.Data)))
+
+	firstPKey := pKey
+	if len(a.pKeys) > 0 {
+		firstPKey = a.pKeys[0]
+	}
+
+	return len(aggregatedMagic) + protoSize + md5.Size + len(firstPKey)
+}
+
+// aggregatedSize returns the size of an aggregated Kinesis record holding
+// only the entry.
+func aggregatedSize(e *kinesis.PutRecordsRequestEntry) int {
+	var empty aggregator
+	return empty.sizeWith(e)
+}
+
+// size returns the size of the aggregated Kinesis record, data and partition
+// key.
+func (a *aggregator) size() int {
+	if a.empty() {
+		return 0
+	}
+	return len(aggregatedMagic) + a.protoSize + md5.Size + len(a.pKeys[0])
+}
+
+func (a *aggregator) add(e *kinesis.PutRecordsRequestEntry) {
+	pKey := *e.PartitionKey
+
+	idx, ok := a.pKeyIndex[pKey]
+	if !ok {
+		idx = len(a.pKeys)
+		a.pKeys = append(a.pKeys, pKey)
+		a.pKeyIndex[pKey] = idx
+		a.protoSize += bytesFieldSize(aggPartitionKeyTableField, len(pKey))
+	}
+
+	var rec []byte
+	rec = appendVarintField(rec, recPartitionKeyIndexField, uint64(idx))
+	rec = appendBytesField(rec, recDataField, e.Data)
+
+	a.records = append(a.records, rec)
+	a.protoSize += bytesFieldSize(aggRecordsField, len(rec))
+}
+
+func (a *aggregator) empty() bool {
+	return len(a.records) == 0
+}
+
+// entry encodes the aggregated record. Its partition key is the partition
+// key of the first user record.
+func (a *aggregator) entry() *kinesis.PutRecordsRequestEntry {
+	proto := make([]byte, 0, a.protoSize)
+	for _, pKey := range a.pKeys {
+		proto = appendBytesField(proto, aggPartitionKeyTableField, []byte(pKey))
+	}
+	for _, rec := range a.records {
+		proto = appendBytesField(proto, aggRecordsField, rec)
+	}
+
+	sum := md5.Sum(proto)
+
+	data := make([]byte, 0, len(aggregatedMagic)+len(proto)+md5.Size)
+	data = append(data, aggregatedMagic...)
+	data = append(data, proto...)
+	data = append(data, sum[:]...)
+
+	return &kinesis.PutRecordsRequestEntry{
+		Data:         data,
+		PartitionKey: aws.String(a.pKeys[0]),
+	}
+}
+
+func (a *aggregator) reset() {
+	a.pKeys = make([]string, 0)
+	a.pKeyIndex = make(map[string]int)
+	a.records = make([][]byte, 0)
+	a.protoSize = 0
+}
+
+func userRecordSize(pKeyIdx, dataLen int) int {
+	return varintFieldSize(recPartitionKeyIndexField, uint64(pKeyIdx)) +
+		bytesFieldSize(recDataField, dataLen)
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	b = appendVarint(b, uint64(field<<3))
+	return appendVarint(b, v)
+}
+
+func appendBytesField(b []byte, field int, data []byte) []byte {
+	b = appendVarint(b, uint64(field<<3|2))
+	b = appendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func varintSize(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+func varintFieldSize(field int, v uint64) int {
+	return varintSize(uint64(field<<3)) + varintSize(v)
+}
+
+func bytesFieldSize(field int, dataLen int) int {
+	return varintSize(uint64(field<<3|2)) + varintSize(uint64(dataLen)) + dataLen
+}
@@ -0,0 +1,124 @@
+package kinesis
+
+import (
+	"crypto/md5"
+	"errors"
+	"testing"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregator_Entry(t *testing.T) {
+	a := newAggregator()
+	a.add(&kinesis.PutRecordsRequestEntry{
+		Data:         []byte("hi"),
+		PartitionKey: aws.String("a"),
+	})
+	a.add(&kinesis.PutRecordsRequestEntry{
+		Data:         []byte("yo"),
+		PartitionKey: aws.String("b"),
+	})
+
+	proto := []byte{
+		0x0A, 0x01, 'a', // partition_key_table
+		0x0A, 0x01, 'b',
+		0x1A, 0x06, 0x08, 0x00, 0x1A, 0x02, 'h', 'i', // records
+		0x1A, 0x06, 0x08, 0x01, 0x1A, 0x02, 'y', 'o',
+	}
+	sum := md5.Sum(proto)
+
+	expected := append([]byte{0xF3, 0x89, 0x9A, 0xC2}, proto...)
+	expected = append(expected, sum[:]...)
+
+	e := a.entry()
+	assert.Equal(t, expected, e.Data)
+	assert.Equal(t, "a", *e.PartitionKey)
+	assert.Equal(t, entrySize(e), a.size())
+}
+
+func TestBuffer_Aggregate(t *testing.T) {
+	tmpl, _ := template.New("").Parse("abc")
+	b := newBuffer(&Config{PKeyTmpl: tmpl, Aggregate: true}, "abc")
+
+	m := &router.Message{
+		Data: "hello",
+		Container: &docker.Container{
+			ID: "123",
+		},
+	}
+
+	for i := 0; i < 3; i++ {
+		e, err := b.entry(m)
+		assert.Nil(t, err)
+		assert.False(t, b.full(e))
+		b.add(e)
+	}
+	assert.False(t, b.empty())
+	assert.Equal(t, 0, b.count)
+
+	b.seal()
+	assert.Equal(t, 1, b.count)
+	assert.Len(t, b.input.Records, 1)
+	assert.Equal(t, b.byteSize, entrySize(b.input.Records[0]))
+}
+
+func TestBuffer_AggregateRecordSizeLimit(t *testing.T) {
+	tmpl, _ := template.New("").Parse("abc")
+	b := newBuffer(&Config{PKeyTmpl: tmpl, Aggregate: true}, "abc")
+	b.limits = &limits{
+		putRecords:     2,
+		putRecordsSize: PutRecordsSizeLimit,
+		recordSize:     50,
+	}
+
+	m := &router.Message{
+		Data: "hello",
+		Container: &docker.Container{
+			ID: "123",
+		},
+	}
+
+	// Each aggregated record fits two messages.
+	for i := 0; i < 4; i++ {
+		e, err := b.entry(m)
+		assert.Nil(t, err)
+		assert.False(t, b.full(e))
+		b.add(e)
+	}
+	assert.Equal(t, 1, b.count)
+
+	e, err := b.entry(m)
+	assert.Nil(t, err)
+	assert.True(t, b.full(e))
+}
+
+type failingCodec struct{}
+
+func (c failingCodec) Marker() byte { return 0 }
+
+func (c failingCodec) Encode(data []byte) ([]byte, error) {
+	return nil, errors.New("boom")
+}
+
+func (c failingCodec) MaxEncodedLen(n int) int { return n }
+
+func TestBuffer_SealEncodeError(t *testing.T) {
+	var reported error
+	ErrorHandler = func(err error) { reported = err }
+	defer func() { ErrorHandler = logErr }()
+
+	b := newBuffer(&Config{Aggregate: true, Codec: failingCodec{}}, "abc")
+	b.metrics = newStreamMetrics()
+	b.add(&kinesis.PutRecordsRequestEntry{Data: []byte("hi"), PartitionKey: aws.String("a")})
+	b.add(&kinesis.PutRecordsRequestEntry{Data: []byte("yo"), PartitionKey: aws.String("b")})
+	b.seal()
+
+	assert.Len(t, b.input.Records, 0)
+	assert.Equal(t, &EncodeError{Stream: "abc", Count: 2, Err: errors.New("boom")}, reported)
+	assert.Equal(t, int64(2), b.metrics.recordsDropped)
+}
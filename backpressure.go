@@ -0,0 +1,84 @@
+package kinesis
+
+import (
+	"fmt"
+	"text/template"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// BackpressurePolicy tells what a flusher does with an input when its queue
+// is full, and what a stream that isn't ready does with a message when its
+// pending queue is full.
+type BackpressurePolicy string
+
+// The backpressure policies.
+const (
+	// DropNewest drops the new input.
+	DropNewest BackpressurePolicy = "drop-newest"
+	// DropOldest drops the oldest input of the queue to make room.
+	DropOldest BackpressurePolicy = "drop-oldest"
+	// Block waits for room in the queue until the block timeout, and then
+	// drops the new input. The writer of the container stops buffering its
+	// logs meanwhile, which blocks the logs of the route.
+	Block BackpressurePolicy = "block"
+	// Spill writes the new input to the spool.
+	Spill BackpressurePolicy = "spill"
+)
+
+const (
+	// DefaultQueueDepth is the default number of inputs queued by a flusher
+	// while it's sending one.
+	DefaultQueueDepth = 10
+
+	// DefaultBlockTimeout is the default maximum wait for room in the queue
+	// with the block policy.
+	DefaultBlockTimeout = time.Minute
+)
+
+// InvalidBackpressureError is returned when the backpressure template doesn't
+// render a known policy, or the spill policy without a spool.
+type InvalidBackpressureError struct {
+	Stream string
+	Value  string
+}
+
+func (e *InvalidBackpressureError) Error() string {
+	return fmt.Sprintf("invalid backpressure policy, using the default. stream: %s, value: %q", e.Stream, e.Value)
+}
+
+// defaultBackpressure returns the policy of the streams without a
+// backpressure template: the inputs are spilled if the spool is enabled,
+// else dropped.
+func defaultBackpressure(config *Config) BackpressurePolicy {
+	if config.Spool != nil {
+		return Spill
+	}
+
+	return DropNewest
+}
+
+// streamBackpressure renders the backpressure policy of the stream. An
+// invalid policy is reported and the default is used.
+func streamBackpressure(tmpl *template.Template, config *Config, sn string, m *router.Message) BackpressurePolicy {
+	value, err := executeOptTmpl(tmpl, m)
+	if err != nil {
+		ErrorHandler(err)
+		return defaultBackpressure(config)
+	}
+
+	switch policy := BackpressurePolicy(value); policy {
+	case "":
+		return defaultBackpressure(config)
+	case DropNewest, DropOldest, Block:
+		return policy
+	case Spill:
+		if config.Spool != nil {
+			return policy
+		}
+	}
+
+	ErrorHandler(&InvalidBackpressureError{Stream: sn, Value: value})
+	return defaultBackpressure(config)
+}
@@ -0,0 +1,151 @@
+package kinesis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamBackpressure(t *testing.T) {
+	var reported error
+	ErrorHandler = func(err error) {
+		if err != nil {
+			reported = err
+		}
+	}
+	defer func() { ErrorHandler = logErr }()
+
+	tmpl, _ := parseTmpl(`{{ label .Container "backpressure" }}`)
+	config := &Config{}
+	policy := func(value string) BackpressurePolicy {
+		c := labeledContainer(map[string]string{"backpressure": value})
+		return streamBackpressure(tmpl, config, "abc", &router.Message{Container: c})
+	}
+
+	assert.Equal(t, DropNewest, streamBackpressure(nil, config, "abc", nil))
+	assert.Equal(t, DropNewest, policy(""))
+	assert.Equal(t, Block, policy("block"))
+	assert.Equal(t, DropOldest, policy("drop-oldest"))
+	assert.Nil(t, reported)
+
+	assert.Equal(t, DropNewest, policy("wait"))
+	assert.IsType(t, &InvalidBackpressureError{}, reported)
+
+	// Spilling requires the spool.
+	reported = nil
+	assert.Equal(t, DropNewest, policy("spill"))
+	assert.IsType(t, &InvalidBackpressureError{}, reported)
+
+	config.Spool = &SpoolConfig{Dir: "/tmp"}
+	assert.Equal(t, Spill, policy(""))
+	assert.Equal(t, Spill, policy("spill"))
+}
+
+func TestNewFlusher_QueueDepth(t *testing.T) {
+	f := newFlusher(&fakeClient{}, flusherConfig{queueDepth: 3}).(*flusher)
+	assert.Equal(t, 3, cap(f.inputs))
+	assert.Equal(t, DropNewest, f.policy)
+
+	f = newFlusher(&fakeClient{}, flusherConfig{}).(*flusher)
+	assert.Equal(t, DefaultQueueDepth, cap(f.inputs))
+	assert.Equal(t, DefaultBlockTimeout, f.blockTimeout)
+}
+
+func TestFlusher_DropOldest(t *testing.T) {
+	var dropped []string
+	metrics := newStreamMetrics()
+	f := &flusher{
+		inputs: make(chan kinesis.PutRecordsInput, 1),
+		dropInputFunc: func(input kinesis.PutRecordsInput) {
+			dropped = append(dropped, string(input.Records[0].Data))
+		},
+		policy:  DropOldest,
+		metrics: metrics,
+	}
+
+	f.flush(*testInput("a"))
+	f.flush(*testInput("b"))
+
+	assert.Equal(t, []string{"a"}, dropped)
+	assert.Equal(t, int64(1), metrics.recordsDropped)
+	assert.Equal(t, 1, f.pending())
+	assert.Equal(t, "b", string((<-f.inputs).Records[0].Data))
+}
+
+func TestFlusher_Block(t *testing.T) {
+	f := &flusher{
+		inputs: make(chan kinesis.PutRecordsInput, 1),
+		dropInputFunc: func(kinesis.PutRecordsInput) {
+			t.Fatal("Expected the input to be queued")
+		},
+		policy: Block,
+	}
+
+	f.flush(*testInput("a"))
+
+	queued := make(chan struct{})
+	go func() {
+		f.flush(*testInput("b"))
+		close(queued)
+	}()
+
+	select {
+	case <-queued:
+		t.Fatal("Expected flush to block")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	assert.Equal(t, "a", string((<-f.inputs).Records[0].Data))
+
+	select {
+	case <-queued:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the input to be queued")
+	}
+	assert.Equal(t, "b", string((<-f.inputs).Records[0].Data))
+}
+
+func TestFlusher_BlockTimeout(t *testing.T) {
+	drop := make(chan struct{})
+	f := &flusher{
+		inputs: make(chan kinesis.PutRecordsInput, 1),
+		dropInputFunc: func(kinesis.PutRecordsInput) {
+			close(drop)
+		},
+		policy:       Block,
+		blockTimeout: 10 * time.Millisecond,
+	}
+
+	f.flush(*testInput("a"))
+	f.flush(*testInput("b"))
+
+	select {
+	case <-drop:
+	default:
+		t.Fatal("Expected the input to be dropped after the timeout")
+	}
+	assert.Equal(t, 1, f.pending())
+}
+
+func TestAdapter_StreamBackpressure(t *testing.T) {
+	sTmpl, _ := parseTmpl("{{ .Container.Name }}")
+	bTmpl, _ := parseTmpl(`{{ if eq .Container.Name "audit" }}block{{ end }}`)
+	a := &Adapter{
+		Streams:          make(map[string]*Stream),
+		StreamTmpl:       sTmpl,
+		BackpressureTmpl: bTmpl,
+		Config:           &Config{Client: &fakeClient{status: "ACTIVE"}, SkipCreate: true, SkipTag: true},
+	}
+
+	s, err := a.stream(&router.Message{Container: &docker.Container{Name: "audit"}}, &overrides{})
+	assert.Nil(t, err)
+	assert.Equal(t, Block, s.backpressure)
+
+	s, err = a.stream(&router.Message{Container: &docker.Container{Name: "debug"}}, &overrides{})
+	assert.Nil(t, err)
+	assert.Equal(t, DropNewest, s.backpressure)
+}
@@ -31,16 +31,27 @@ const (
 )
 
 type buffer struct {
-	count    int
-	byteSize int
-	pKeyTmpl *template.Template
-	input    *kinesis.PutRecordsInput
-	limits   *limits
+	count     int
+	byteSize  int
+	pKeyTmpl  *template.Template
+	formatter Formatter
+	agg       *aggregator
+	codec     Codec
+	marker    bool
+	noPKey    bool
+	input     *kinesis.PutRecordsInput
+	limits    *limits
+	metrics   *streamMetrics
+	debug     debugLogger
 }
 
-func newBuffer(tmpl *template.Template, sn string) *buffer {
-	return &buffer{
-		pKeyTmpl: tmpl,
+func newBuffer(config *Config, sn string) *buffer {
+	b := &buffer{
+		pKeyTmpl:  config.PKeyTmpl,
+		formatter: config.Formatter,
+		codec:     config.Codec,
+		marker:    config.CodecMarker,
+		debug:     debugLogger(config.Debug),
 		input: &kinesis.PutRecordsInput{
 			StreamName: aws.String(sn),
 			Records:    make([]*kinesis.PutRecordsRequestEntry, 0),
@@ -51,53 +62,221 @@ func newBuffer(tmpl *template.Template, sn string) *buffer {
 			recordSize:     RecordSizeLimit,
 		},
 	}
+
+	// Firehose has its own limits, and no partition key.
+	if config.Firehose != nil {
+		b.noPKey = true
+		b.limits = &limits{
+			putRecords:     PutRecordBatchLimit,
+			putRecordsSize: PutRecordBatchSizeLimit,
+			recordSize:     FirehoseRecordSizeLimit,
+		}
+	}
+
+	// We default to the raw format if none is given.
+	if b.formatter == nil {
+		b.formatter = &rawFormatter{}
+	}
+
+	if config.Aggregate {
+		b.agg = newAggregator()
+	}
+
+	return b
 }
 
-func (b *buffer) add(m *router.Message) error {
-	dataLen := len(m.Data)
+// override replaces the partition key template and the formatter with the
+// ones of the container labels, if set.
+func (b *buffer) override(o *overrides) {
+	if o.pKeyTmpl != nil {
+		b.pKeyTmpl = o.pKeyTmpl
+	}
+	if o.formatter != nil {
+		b.formatter = o.formatter
+	}
+}
+
+// fill returns the number of records and bytes in the buffer, counting the
+// records being aggregated as one.
+func (b *buffer) fill() (int, int) {
+	records, bytes := b.count, b.byteSize
+	if b.agg != nil && !b.agg.empty() {
+		records++
+		bytes += b.agg.size()
+	}
+
+	return records, bytes
+}
+
+// entry formats the message into a record.
+func (b *buffer) entry(m *router.Message) (*kinesis.PutRecordsRequestEntry, error) {
+	data, err := b.formatter.Format(m)
+	if err != nil {
+		return nil, &TemplateError{Container: m.Container.ID, Err: err}
+	}
+
+	pKey, err := b.pKey(m)
+	if err != nil {
+		return nil, &TemplateError{Container: m.Container.ID, Err: err}
+	}
+
+	e := &kinesis.PutRecordsRequestEntry{
+		Data:         data,
+		PartitionKey: aws.String(pKey),
+	}
+
+	// When aggregating, the aggregated record is compressed once sealed.
+	if b.agg != nil {
+		// This record doesn't fit in an aggregated record on its own.
+		if b.maxEncodedLen(aggregatedSize(e)) > b.limits.recordSize {
+			return nil, ErrRecordTooBig
+		}
+
+		return e, nil
+	}
+
+	if e.Data, err = b.encode(data); err != nil {
+		return nil, err
+	}
 
 	// This record is too large, we can't submit it to kinesis.
-	if dataLen > b.limits.recordSize {
-		return ErrRecordTooBig
+	if len(e.Data) > b.limits.recordSize {
+		return nil, ErrRecordTooBig
+	}
+
+	return e, nil
+}
+
+func (b *buffer) pKey(m *router.Message) (string, error) {
+	if b.noPKey {
+		return "", nil
 	}
 
 	pKey, err := executeTmpl(b.pKeyTmpl, m)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// We default to a uuid if the template didn't match.
 	if pKey == "" {
 		pKey = uuid.New()
-		debug("the partition key is an empty string, defaulting to a uuid %s", pKey)
+		b.debug.printf("the partition key is an empty string, defaulting to a uuid %s", pKey)
+	}
+
+	return pKey, nil
+}
+
+// encode compresses the data with the codec, if any.
+func (b *buffer) encode(data []byte) ([]byte, error) {
+	if b.codec == nil {
+		return data, nil
+	}
+
+	encoded, err := b.codec.Encode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.marker {
+		encoded = append([]byte{b.codec.Marker()}, encoded...)
+	}
+
+	return encoded, nil
+}
+
+// maxEncodedLen returns the maximum size of n bytes once compressed.
+func (b *buffer) maxEncodedLen(n int) int {
+	if b.codec == nil {
+		return n
+	}
+
+	if b.marker {
+		return b.codec.MaxEncodedLen(n) + 1
+	}
+
+	return b.codec.MaxEncodedLen(n)
+}
+
+func (b *buffer) add(e *kinesis.PutRecordsRequestEntry) {
+	if b.agg != nil {
+		b.aggregate(e)
+		return
+	}
+
+	b.addRecord(e)
+
+	b.debug.printf("record added, stream: %s, partition key: %s, length: %d",
+		*b.input.StreamName, *e.PartitionKey, len(b.input.Records))
+}
+
+// aggregate adds the entry to the pending aggregated record, after moving
+// the pending record to the request if the entry doesn't fit in it.
+func (b *buffer) aggregate(e *kinesis.PutRecordsRequestEntry) {
+	if b.maxEncodedLen(b.agg.sizeWith(e)) > b.limits.recordSize {
+		b.seal()
 	}
 
+	b.agg.add(e)
+
+	b.debug.printf("record aggregated, stream: %s, partition key: %s, length: %d",
+		*b.input.StreamName, *e.PartitionKey, len(b.agg.records))
+}
+
+// seal moves the pending aggregated record, if any, to the request.
+func (b *buffer) seal() {
+	if b.agg == nil || b.agg.empty() {
+		return
+	}
+
+	e := b.agg.entry()
+	count := len(b.agg.records)
+	b.agg.reset()
+
+	data, err := b.encode(e.Data)
+	if err != nil {
+		b.metrics.dropped(count)
+		ErrorHandler(&EncodeError{Stream: *b.input.StreamName, Count: count, Err: err})
+		return
+	}
+	e.Data = data
+
+	b.addRecord(e)
+}
+
+func (b *buffer) addRecord(e *kinesis.PutRecordsRequestEntry) {
 	// Add to count
 	b.count++
 
 	// Add data and partition key size to byteSize
-	b.byteSize += dataLen + len(pKey)
+	b.byteSize += entrySize(e)
 
 	// Add record
-	b.input.Records = append(b.input.Records, &kinesis.PutRecordsRequestEntry{
-		Data:         []byte(m.Data),
-		PartitionKey: aws.String(pKey),
-	})
+	b.input.Records = append(b.input.Records, e)
+}
 
-	debug("record added, stream: %s, partition key: %s, length: %d",
-		*b.input.StreamName, pKey, len(b.input.Records))
+func (b *buffer) full(e *kinesis.PutRecordsRequestEntry) bool {
+	count := b.count + 1
+	byteSize := b.byteSize + entrySize(e)
 
-	return nil
-}
+	// When aggregating, the entry either grows the pending aggregated record,
+	// or starts a new one after it. We don't know their compressed size yet,
+	// so we count their maximum size.
+	if b.agg != nil {
+		if size := b.maxEncodedLen(b.agg.sizeWith(e)); size <= b.limits.recordSize {
+			byteSize = b.byteSize + size
+		} else {
+			count++
+			byteSize = b.byteSize + b.maxEncodedLen(b.agg.size()) + b.maxEncodedLen(aggregatedSize(e))
+		}
+	}
 
-func (b *buffer) full(m *router.Message) bool {
 	// Adding this event would make our request have too many records.
-	if b.count+1 > b.limits.putRecords {
+	if count > b.limits.putRecords {
 		return true
 	}
 
 	// Adding this event would make our request too large.
-	if b.byteSize+len(m.Data) > b.limits.putRecordsSize {
+	if byteSize > b.limits.putRecordsSize {
 		return true
 	}
 
@@ -105,13 +284,20 @@ func (b *buffer) full(m *router.Message) bool {
 }
 
 func (b *buffer) empty() bool {
-	return b.count == 0
+	return b.count == 0 && (b.agg == nil || b.agg.empty())
 }
 
 func (b *buffer) reset() {
 	b.count = 0
 	b.byteSize = 0
 	b.input.Records = make([]*kinesis.PutRecordsRequestEntry, 0)
+	if b.agg != nil {
+		b.agg.reset()
+	}
+
+	b.debug.printf("buffer reset, stream: %s", *b.input.StreamName)
+}
 
-	debug("buffer reset, stream: %s", *b.input.StreamName)
+func entrySize(e *kinesis.PutRecordsRequestEntry) int {
+	return len(e.Data) + len(*e.PartitionKey)
 }
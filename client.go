@@ -1,15 +1,38 @@
 package kinesis
 
 import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/firehose"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 )
 
+// DescribeStreamError is returned when the status of a stream couldn't be
+// retrieved.
+type DescribeStreamError struct {
+	Stream string
+	Err    error
+}
+
+func (e *DescribeStreamError) Error() string {
+	return fmt.Sprintf("couldn't describe stream: %s, %s", e.Stream, e.Err)
+}
+
 // Client is a wrapper for the AWS Kinesis client.
 type Client interface {
 	Create(*kinesis.CreateStreamInput) (bool, error)
-	Status(*kinesis.DescribeStreamInput) string
+	Status(*kinesis.DescribeStreamInput) (string, error)
 	Tag(*kinesis.AddTagsToStreamInput) error
+	Tags(*kinesis.ListTagsForStreamInput) (map[string]string, error)
+	Reshard(*kinesis.UpdateShardCountInput) error
+	Shards(*kinesis.DescribeStreamSummaryInput) (int64, error)
+	Encryption(*kinesis.DescribeStreamInput) (encryption, keyID string, err error)
+	Encrypt(*kinesis.StartStreamEncryptionInput) error
 	PutRecords(inp *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error)
 }
 
@@ -17,6 +40,63 @@ type client struct {
 	kinesis *kinesis.Kinesis
 }
 
+// NewClient creates a client for the session, sending the records to
+// Firehose delivery streams if firehose is set.
+func NewClient(sess *session.Session, firehoseConfig *FirehoseConfig) Client {
+	if firehoseConfig != nil {
+		return &firehoseClient{
+			firehose: firehose.New(sess),
+			config:   firehoseConfig,
+		}
+	}
+
+	return &client{
+		kinesis: kinesis.New(sess),
+	}
+}
+
+// roleClients caches the clients of the roles assumed by the streams.
+type roleClients struct {
+	session *session.Session
+	// sts assumes the roles, at stsEndpoint rather than the endpoint of the
+	// session.
+	sts      *session.Session
+	firehose *FirehoseConfig
+	clients  map[string]Client
+	debug    debugLogger
+}
+
+func newRoleClients(sess *session.Session, stsEndpoint string, firehoseConfig *FirehoseConfig, debug debugLogger) *roleClients {
+	return &roleClients{
+		debug:    debug,
+		session:  sess,
+		sts:      sess.Copy(&aws.Config{Endpoint: aws.String(stsEndpoint)}),
+		firehose: firehoseConfig,
+		clients:  make(map[string]Client),
+	}
+}
+
+// get returns the client of the role, assumed with the external ID if set.
+// The credentials of the role are refreshed before they expire.
+func (r *roleClients) get(roleARN, externalID string) Client {
+	key := roleARN + "|" + externalID
+	if c, ok := r.clients[key]; ok {
+		return c
+	}
+
+	creds := stscreds.NewCredentials(r.sts, roleARN, func(p *stscreds.AssumeRoleProvider) {
+		if externalID != "" {
+			p.ExternalID = aws.String(externalID)
+		}
+	})
+
+	c := NewClient(r.session.Copy(&aws.Config{Credentials: creds}), r.firehose)
+	r.clients[key] = c
+
+	r.debug.printf("assuming role: %s", roleARN)
+	return c
+}
+
 func (c *client) Create(input *kinesis.CreateStreamInput) (bool, error) {
 	_, err := c.kinesis.CreateStream(input)
 
@@ -33,9 +113,34 @@ func (c *client) Create(input *kinesis.CreateStreamInput) (bool, error) {
 	return false, nil
 }
 
-func (c *client) Status(input *kinesis.DescribeStreamInput) string {
-	resp, _ := c.kinesis.DescribeStream(input)
-	return *resp.StreamDescription.StreamStatus
+func (c *client) Status(input *kinesis.DescribeStreamInput) (string, error) {
+	desc, err := c.describe(input)
+	if err != nil {
+		return "", err
+	}
+
+	return aws.StringValue(desc.StreamStatus), nil
+}
+
+// describe returns the description of the stream, or an error if it's
+// missing from the response.
+func (c *client) describe(input *kinesis.DescribeStreamInput) (*kinesis.StreamDescription, error) {
+	resp, err := c.kinesis.DescribeStream(input)
+	if err != nil {
+		return nil, &DescribeStreamError{
+			Stream: aws.StringValue(input.StreamName),
+			Err:    err,
+		}
+	}
+
+	if resp == nil || resp.StreamDescription == nil {
+		return nil, &DescribeStreamError{
+			Stream: aws.StringValue(input.StreamName),
+			Err:    errors.New("missing stream description"),
+		}
+	}
+
+	return resp.StreamDescription, nil
 }
 
 func (c *client) Tag(input *kinesis.AddTagsToStreamInput) error {
@@ -47,6 +152,68 @@ func (c *client) Tag(input *kinesis.AddTagsToStreamInput) error {
 	return nil
 }
 
+// Tags returns the tags of the stream, reading all their pages.
+func (c *client) Tags(input *kinesis.ListTagsForStreamInput) (map[string]string, error) {
+	tags := make(map[string]string)
+	for {
+		resp, err := c.kinesis.ListTagsForStream(input)
+		if err != nil {
+			return nil, err
+		}
+
+		var last *string
+		for _, t := range resp.Tags {
+			tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+			last = t.Key
+		}
+		if !aws.BoolValue(resp.HasMoreTags) || last == nil {
+			return tags, nil
+		}
+
+		next := *input
+		next.ExclusiveStartTagKey = last
+		input = &next
+	}
+}
+
+func (c *client) Reshard(input *kinesis.UpdateShardCountInput) error {
+	_, err := c.kinesis.UpdateShardCount(input)
+	return err
+}
+
+func (c *client) Shards(input *kinesis.DescribeStreamSummaryInput) (int64, error) {
+	resp, err := c.kinesis.DescribeStreamSummary(input)
+	if err != nil {
+		return 0, &DescribeStreamError{
+			Stream: aws.StringValue(input.StreamName),
+			Err:    err,
+		}
+	}
+
+	if resp == nil || resp.StreamDescriptionSummary == nil {
+		return 0, &DescribeStreamError{
+			Stream: aws.StringValue(input.StreamName),
+			Err:    errors.New("missing stream description summary"),
+		}
+	}
+
+	return aws.Int64Value(resp.StreamDescriptionSummary.OpenShardCount), nil
+}
+
+func (c *client) Encryption(input *kinesis.DescribeStreamInput) (string, string, error) {
+	desc, err := c.describe(input)
+	if err != nil {
+		return "", "", err
+	}
+
+	return aws.StringValue(desc.EncryptionType), aws.StringValue(desc.KeyId), nil
+}
+
+func (c *client) Encrypt(input *kinesis.StartStreamEncryptionInput) error {
+	_, err := c.kinesis.StartStreamEncryption(input)
+	return err
+}
+
 func (c *client) PutRecords(inp *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
 	return c.kinesis.PutRecords(inp)
 }
@@ -0,0 +1,176 @@
+package kinesis
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/gliderlabs/logspout/router"
+	"github.com/stretchr/testify/assert"
+)
+
+const assumeRoleResponse = `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>ROLEKEY</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>token</SessionToken>
+      <Expiration>2099-01-01T00:00:00Z</Expiration>
+    </Credentials>
+    <AssumedRoleUser>
+      <Arn>arn:aws:sts::123456789012:assumed-role/logs/session</Arn>
+      <AssumedRoleId>id:session</AssumedRoleId>
+    </AssumedRoleUser>
+  </AssumeRoleResult>
+</AssumeRoleResponse>`
+
+// kinesisStandIn answers the Kinesis API calls like a local stand-in would,
+// e.g. kinesalite.
+func kinesisStandIn(t *testing.T) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+
+		switch target := r.Header.Get("X-Amz-Target"); {
+		case target == "":
+			// STS AssumeRole.
+			form, _ := url.ParseQuery(string(body))
+			assert.Equal(t, "AssumeRole", form.Get("Action"))
+			assert.Equal(t, "ext", form.Get("ExternalId"))
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write([]byte(assumeRoleResponse))
+		case strings.HasSuffix(target, ".CreateStream"):
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type": "ResourceInUseException", "message": "Stream abc already exists"}`))
+		case strings.Contains(string(body), `"StreamName":"empty"`):
+			// A partial response, e.g. from a stub.
+			w.Write([]byte(`{}`))
+		case strings.HasSuffix(target, ".DescribeStreamSummary"):
+			w.Write([]byte(`{"StreamDescriptionSummary": {"StreamName": "abc", "OpenShardCount": 2}}`))
+		case strings.HasSuffix(target, ".DescribeStream"):
+			assert.Contains(t, string(body), `"StreamName":"abc"`)
+			w.Write([]byte(`{"StreamDescription": {"StreamName": "abc", "StreamStatus": "ACTIVE", "EncryptionType": "KMS", "KeyId": "alias/logs"}}`))
+		case strings.HasSuffix(target, ".PutRecords"):
+			w.Write([]byte(`{"FailedRecordCount": 0, "Records": [{"SequenceNumber": "1", "ShardId": "shardId-000000000000"}]}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type": "UnknownOperationException"}`))
+		}
+	}))
+}
+
+func TestClient_StandIn(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "key")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	server := kinesisStandIn(t)
+	defer server.Close()
+
+	sess, err := routeSession(&router.Route{
+		Address: "us-east-1",
+		Options: map[string]string{
+			"endpoint":    server.URL,
+			"tls_verify":  "false",
+			"max_retries": "0",
+		},
+	})
+	assert.Nil(t, err)
+	c := NewClient(sess, nil)
+
+	exists, err := c.Create(&kinesis.CreateStreamInput{
+		StreamName: aws.String("abc"),
+		ShardCount: aws.Int64(1),
+	})
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	status, err := c.Status(&kinesis.DescribeStreamInput{StreamName: aws.String("abc")})
+	assert.Nil(t, err)
+	assert.Equal(t, kinesis.StreamStatusActive, status)
+
+	encryption, keyID, err := c.Encryption(&kinesis.DescribeStreamInput{StreamName: aws.String("abc")})
+	assert.Nil(t, err)
+	assert.Equal(t, kinesis.EncryptionTypeKms, encryption)
+	assert.Equal(t, "alias/logs", keyID)
+
+	shards, err := c.Shards(&kinesis.DescribeStreamSummaryInput{StreamName: aws.String("abc")})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), shards)
+
+	// The missing descriptions are errors.
+	_, err = c.Status(&kinesis.DescribeStreamInput{StreamName: aws.String("empty")})
+	assert.IsType(t, &DescribeStreamError{}, err)
+	_, _, err = c.Encryption(&kinesis.DescribeStreamInput{StreamName: aws.String("empty")})
+	assert.IsType(t, &DescribeStreamError{}, err)
+	_, err = c.Shards(&kinesis.DescribeStreamSummaryInput{StreamName: aws.String("empty")})
+	assert.IsType(t, &DescribeStreamError{}, err)
+
+	out, err := c.PutRecords(testInput("abc"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), aws.Int64Value(out.FailedRecordCount))
+
+	err = c.Tag(&kinesis.AddTagsToStreamInput{StreamName: aws.String("abc")})
+	assert.NotNil(t, err)
+}
+
+func TestClient_TLSVerify(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "key")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	server := kinesisStandIn(t)
+	defer server.Close()
+
+	// The stand-in certificate is self-signed.
+	sess, err := routeSession(&router.Route{
+		Address: "us-east-1",
+		Options: map[string]string{"endpoint": server.URL, "max_retries": "0"},
+	})
+	assert.Nil(t, err)
+
+	_, err = NewClient(sess, nil).Status(&kinesis.DescribeStreamInput{StreamName: aws.String("abc")})
+	assert.IsType(t, &DescribeStreamError{}, err)
+}
+
+func TestRoleClients(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "key")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	var authorization string
+	standIn := kinesisStandIn(t)
+	defer standIn.Close()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") != "" {
+			authorization = r.Header.Get("Authorization")
+		}
+		standIn.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	sess, err := routeSession(&router.Route{
+		Address: "us-east-1",
+		Options: map[string]string{"endpoint": server.URL, "tls_verify": "false", "max_retries": "0"},
+	})
+	assert.Nil(t, err)
+
+	roles := newRoleClients(sess, server.URL, nil, false)
+	c := roles.get("arn:aws:iam::123456789012:role/logs", "ext")
+	assert.True(t, c == roles.get("arn:aws:iam::123456789012:role/logs", "ext"), "The client should be cached")
+	assert.False(t, c == roles.get("arn:aws:iam::123456789012:role/other", "ext"))
+
+	status, err := c.Status(&kinesis.DescribeStreamInput{StreamName: aws.String("abc")})
+	assert.Nil(t, err)
+	assert.Equal(t, kinesis.StreamStatusActive, status)
+	assert.Contains(t, authorization, "Credential=ROLEKEY/")
+}
@@ -0,0 +1,378 @@
+package kinesis
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/gliderlabs/logspout/router"
+)
+
+const (
+	// DefaultCloudWatchInterval is the default period between two
+	// publications of the metrics to CloudWatch.
+	DefaultCloudWatchInterval = time.Minute
+
+	// MetricDataPerRequest is the maximum number of metrics published by a
+	// single PutMetricData request.
+	MetricDataPerRequest = 1000
+
+	// StreamNameDimension is the dimension of the stream name, set on all
+	// the metrics.
+	StreamNameDimension = "StreamName"
+)
+
+// InvalidDimensionError is returned when a dimension of
+// KINESIS_CLOUDWATCH_DIMENSIONS isn't a name=template pair.
+type InvalidDimensionError struct {
+	Dimension string
+}
+
+func (e *InvalidDimensionError) Error() string {
+	return fmt.Sprintf("invalid dimension: %q, expected name=template in KINESIS_CLOUDWATCH_DIMENSIONS", e.Dimension)
+}
+
+// DimensionError is returned when a dimension couldn't be rendered from the
+// first message of a container, its metrics are then published without it.
+type DimensionError struct {
+	Stream    string
+	Dimension string
+	Err       error
+}
+
+func (e *DimensionError) Error() string {
+	return fmt.Sprintf("couldn't render the dimension, publishing without it. stream: %s, dimension: %s, %s", e.Stream, e.Dimension, e.Err)
+}
+
+// PublishMetricsError is returned when the metrics couldn't be published to
+// CloudWatch, their counts are then lost.
+type PublishMetricsError struct {
+	Namespace string
+	Count     int
+	Err       error
+}
+
+func (e *PublishMetricsError) Error() string {
+	return fmt.Sprintf("couldn't publish metrics, namespace: %s, # items: %d, %s", e.Namespace, e.Count, e.Err)
+}
+
+// MetricsClient is a wrapper for the AWS CloudWatch client.
+type MetricsClient interface {
+	PutMetricData(*cloudwatch.PutMetricDataInput) error
+}
+
+type metricsClient struct {
+	cloudwatch *cloudwatch.CloudWatch
+}
+
+// NewMetricsClient creates a CloudWatch client for the session.
+func NewMetricsClient(sess *session.Session) MetricsClient {
+	return &metricsClient{
+		cloudwatch: cloudwatch.New(sess),
+	}
+}
+
+func (c *metricsClient) PutMetricData(input *cloudwatch.PutMetricDataInput) error {
+	_, err := c.cloudwatch.PutMetricData(input)
+	return err
+}
+
+// CloudWatchConfig holds the settings of the publication of the metrics of
+// the streams to CloudWatch.
+type CloudWatchConfig struct {
+	Client    MetricsClient
+	Namespace string
+
+	// Interval is the period between two publications. Zero uses the
+	// default.
+	Interval time.Duration
+
+	// DimensionTmpls are rendered from the first message of each container,
+	// and added to the stream name dimension of its metrics. The containers
+	// of a stream with the same dimensions share their metrics, and the
+	// metrics of the whole stream are published with the stream name
+	// dimension only.
+	DimensionTmpls map[string]*template.Template
+}
+
+// cloudWatchConfig reads the CloudWatch settings of the route, or returns
+// nil if the publication is disabled.
+func cloudWatchConfig(route *router.Route, sess *session.Session) (*CloudWatchConfig, error) {
+	namespace := routeOpt(route, "KINESIS_CLOUDWATCH_NAMESPACE")
+	if namespace == "" {
+		return nil, nil
+	}
+
+	options, err := tmplOptions(route)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpls, err := parseKeyTmpls(routeOpt(route, "KINESIS_CLOUDWATCH_DIMENSIONS"), func(dimension string) error {
+		return &InvalidDimensionError{Dimension: dimension}
+	}, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := routeOpt(route, "KINESIS_CLOUDWATCH_ENDPOINT")
+
+	return &CloudWatchConfig{
+		Client:         NewMetricsClient(sess.Copy(&aws.Config{Endpoint: aws.String(endpoint)})),
+		Namespace:      namespace,
+		Interval:       getDurationOpt(route, "KINESIS_CLOUDWATCH_INTERVAL", DefaultCloudWatchInterval),
+		DimensionTmpls: tmpls,
+	}, nil
+}
+
+// streamDimensions renders the dimensions of a container of the stream from
+// the message, the dimensions with an empty value are skipped, and those that
+// can't be rendered are reported and skipped.
+func streamDimensions(config *CloudWatchConfig, sn string, m *router.Message, debug debugLogger) map[string]string {
+	if config == nil {
+		return nil
+	}
+
+	dimensions := make(map[string]string, len(config.DimensionTmpls))
+	for name, tmpl := range config.DimensionTmpls {
+		value, err := executeTmpl(tmpl, m)
+		if err != nil {
+			ErrorHandler(&DimensionError{Stream: sn, Dimension: name, Err: err})
+			continue
+		}
+
+		if value == "" {
+			debug.printf("the dimension value is empty, skipping the dimension: %s", name)
+			continue
+		}
+		dimensions[name] = value
+	}
+
+	return dimensions
+}
+
+// dimensionMetrics are the metrics of the containers of a stream sharing the
+// same dimensions.
+type dimensionMetrics struct {
+	dimensions map[string]string
+	metrics    *streamMetrics
+}
+
+// containerMetrics returns the metrics of the container of the message,
+// shared by the containers with the same dimensions and counting in the
+// metrics of the stream too, or the metrics of the stream if it has no
+// dimensions.
+func (s *Stream) containerMetrics(m *router.Message) *streamMetrics {
+	dimensions := streamDimensions(s.config.CloudWatch, s.name, m, s.debug)
+	if len(dimensions) == 0 {
+		return s.metrics
+	}
+
+	key := dimensionsKey(dimensions)
+
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+
+	dm, ok := s.dimensionMetrics[key]
+	if !ok {
+		dm = &dimensionMetrics{dimensions: dimensions, metrics: newStreamMetrics()}
+		dm.metrics.parent = s.metrics
+		s.dimensionMetrics[key] = dm
+	}
+
+	return dm.metrics
+}
+
+// dimensionsKey identifies the dimensions, sorted by name.
+func dimensionsKey(dimensions map[string]string) string {
+	names := make([]string, 0, len(dimensions))
+	for name := range dimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var key strings.Builder
+	for _, name := range names {
+		key.WriteString(name + "=" + dimensions[name] + "\x00")
+	}
+
+	return key.String()
+}
+
+// cloudWatchCounts are the counters of a stream published to CloudWatch.
+type cloudWatchCounts struct {
+	recordsSent    int64
+	recordsFailed  int64
+	recordsDropped int64
+	bytesSent      int64
+}
+
+func loadCloudWatchCounts(m *streamMetrics) cloudWatchCounts {
+	return cloudWatchCounts{
+		recordsSent:    atomic.LoadInt64(&m.recordsFlushed),
+		recordsFailed:  atomic.LoadInt64(&m.recordsFailed),
+		recordsDropped: atomic.LoadInt64(&m.recordsDropped),
+		bytesSent:      atomic.LoadInt64(&m.bytesFlushed),
+	}
+}
+
+// cloudWatchPublisher publishes the counters of the streams of an adapter to
+// CloudWatch, as the difference since the previous publication.
+type cloudWatchPublisher struct {
+	config  CloudWatchConfig
+	streams func() map[string]*Stream
+	last    map[*streamMetrics]cloudWatchCounts
+	now     func() time.Time
+}
+
+func newCloudWatchPublisher(config *CloudWatchConfig, streams func() map[string]*Stream) *cloudWatchPublisher {
+	p := &cloudWatchPublisher{
+		config:  *config,
+		streams: streams,
+		last:    make(map[*streamMetrics]cloudWatchCounts),
+		now:     time.Now,
+	}
+
+	if p.config.Interval <= 0 {
+		p.config.Interval = DefaultCloudWatchInterval
+	}
+
+	return p
+}
+
+// run publishes the metrics every interval until quit is closed, and a last
+// time then.
+func (p *cloudWatchPublisher) run(quit <-chan struct{}) {
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.publish()
+		case <-quit:
+			p.publish()
+			return
+		}
+	}
+}
+
+// publish sends the counters of the streams in batches of at most
+// MetricDataPerRequest metrics.
+func (p *cloudWatchPublisher) publish() {
+	data := p.metricData()
+
+	for len(data) > 0 {
+		n := len(data)
+		if n > MetricDataPerRequest {
+			n = MetricDataPerRequest
+		}
+
+		err := p.config.Client.PutMetricData(&cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(p.config.Namespace),
+			MetricData: data[:n],
+		})
+		if err != nil {
+			ErrorHandler(&PublishMetricsError{Namespace: p.config.Namespace, Count: n, Err: err})
+		}
+
+		data = data[n:]
+	}
+}
+
+// metricData returns the metrics of the streams since the previous call.
+func (p *cloudWatchPublisher) metricData() []*cloudwatch.MetricDatum {
+	streams := p.streams()
+
+	keys := make([]string, 0, len(streams))
+	for key := range streams {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var data []*cloudwatch.MetricDatum
+	for _, key := range keys {
+		s := streams[key]
+		data = append(data, p.countData(s.metrics, cloudWatchDimensions(s.name, nil))...)
+
+		for _, dm := range s.sortedDimensionMetrics() {
+			data = append(data, p.countData(dm.metrics, cloudWatchDimensions(s.name, dm.dimensions))...)
+		}
+	}
+
+	return data
+}
+
+// countData returns the counts of the metrics since the previous call, with
+// the dimensions.
+func (p *cloudWatchPublisher) countData(m *streamMetrics, dimensions []*cloudwatch.Dimension) []*cloudwatch.MetricDatum {
+	counts := loadCloudWatchCounts(m)
+	last := p.last[m]
+	p.last[m] = counts
+
+	now := p.now()
+	datum := func(name, unit string, value int64) *cloudwatch.MetricDatum {
+		return &cloudwatch.MetricDatum{
+			MetricName: aws.String(name),
+			Dimensions: dimensions,
+			Timestamp:  aws.Time(now),
+			Unit:       aws.String(unit),
+			Value:      aws.Float64(float64(value)),
+		}
+	}
+
+	return []*cloudwatch.MetricDatum{
+		datum("RecordsSent", cloudwatch.StandardUnitCount, counts.recordsSent-last.recordsSent),
+		datum("RecordsFailed", cloudwatch.StandardUnitCount, counts.recordsFailed-last.recordsFailed),
+		datum("RecordsDropped", cloudwatch.StandardUnitCount, counts.recordsDropped-last.recordsDropped),
+		datum("BytesSent", cloudwatch.StandardUnitBytes, counts.bytesSent-last.bytesSent),
+	}
+}
+
+// sortedDimensionMetrics returns the metrics of the containers of the stream
+// by dimensions, sorted by dimensions.
+func (s *Stream) sortedDimensionMetrics() []*dimensionMetrics {
+	s.statsMutex.RLock()
+	defer s.statsMutex.RUnlock()
+
+	keys := make([]string, 0, len(s.dimensionMetrics))
+	for key := range s.dimensionMetrics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sorted := make([]*dimensionMetrics, 0, len(keys))
+	for _, key := range keys {
+		sorted = append(sorted, s.dimensionMetrics[key])
+	}
+
+	return sorted
+}
+
+// cloudWatchDimensions returns the stream name dimension followed by the
+// rendered dimensions, sorted by name.
+func cloudWatchDimensions(stream string, rendered map[string]string) []*cloudwatch.Dimension {
+	names := make([]string, 0, len(rendered))
+	for name := range rendered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	dimensions := []*cloudwatch.Dimension{
+		{Name: aws.String(StreamNameDimension), Value: aws.String(stream)},
+	}
+	for _, name := range names {
+		dimensions = append(dimensions, &cloudwatch.Dimension{
+			Name:  aws.String(name),
+			Value: aws.String(rendered[name]),
+		})
+	}
+
+	return dimensions
+}
@@ -0,0 +1,157 @@
+package kinesis
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeMetricsClient struct {
+	inputs []*cloudwatch.PutMetricDataInput
+	err    error
+}
+
+func (c *fakeMetricsClient) PutMetricData(input *cloudwatch.PutMetricDataInput) error {
+	c.inputs = append(c.inputs, input)
+	return c.err
+}
+
+func testPublisher(client MetricsClient, streams map[string]*Stream) *cloudWatchPublisher {
+	p := newCloudWatchPublisher(&CloudWatchConfig{Client: client, Namespace: "Logspout"},
+		func() map[string]*Stream { return streams })
+	p.now = func() time.Time { return time.Unix(0, 0) }
+	return p
+}
+
+func TestCloudWatchPublisher(t *testing.T) {
+	tmpls, err := parseKeyTmpls(`app={{ label .Container "app" }};host=h1`, nil)
+	assert.Nil(t, err)
+	s := NewStream(StreamSpec{Name: "abc"},
+		&Config{Client: &fakeClient{}, CloudWatch: &CloudWatchConfig{DimensionTmpls: tmpls}})
+
+	// The containers of the same app share their metrics.
+	web := s.containerMetrics(&router.Message{Container: labeledContainer(map[string]string{"app": "web"})})
+	worker := s.containerMetrics(&router.Message{Container: labeledContainer(map[string]string{"app": "worker"})})
+	assert.True(t, web == s.containerMetrics(&router.Message{Container: labeledContainer(map[string]string{"app": "web"})}))
+
+	web.flushed(3, 30)
+	web.dropped(2)
+	worker.flushed(1, 10)
+
+	client := &fakeMetricsClient{}
+	p := testPublisher(client, map[string]*Stream{"abc": s})
+
+	p.publish()
+	assert.Len(t, client.inputs, 1)
+	assert.Equal(t, "Logspout", aws.StringValue(client.inputs[0].Namespace))
+
+	// The metrics of the stream come first, with the stream name only.
+	data := client.inputs[0].MetricData
+	assert.Len(t, data, 12)
+	assert.Equal(t, "RecordsSent", aws.StringValue(data[0].MetricName))
+	assert.Equal(t, float64(4), aws.Float64Value(data[0].Value))
+	assert.Equal(t, float64(2), aws.Float64Value(data[2].Value))
+	assert.Equal(t, "BytesSent", aws.StringValue(data[3].MetricName))
+	assert.Equal(t, cloudwatch.StandardUnitBytes, aws.StringValue(data[3].Unit))
+	assert.Equal(t, float64(40), aws.Float64Value(data[3].Value))
+	assert.Len(t, data[0].Dimensions, 1)
+	assert.Equal(t, StreamNameDimension, aws.StringValue(data[0].Dimensions[0].Name))
+	assert.Equal(t, "abc", aws.StringValue(data[0].Dimensions[0].Value))
+
+	// Then the metrics of each app.
+	assert.Equal(t, float64(3), aws.Float64Value(data[4].Value))
+	assert.Equal(t, float64(1), aws.Float64Value(data[8].Value))
+
+	dimensions := data[4].Dimensions
+	assert.Len(t, dimensions, 3)
+	assert.Equal(t, StreamNameDimension, aws.StringValue(dimensions[0].Name))
+	assert.Equal(t, "app", aws.StringValue(dimensions[1].Name))
+	assert.Equal(t, "web", aws.StringValue(dimensions[1].Value))
+	assert.Equal(t, "host", aws.StringValue(dimensions[2].Name))
+	assert.Equal(t, "worker", aws.StringValue(data[8].Dimensions[1].Value))
+
+	// Only the counts since the previous publication are sent.
+	web.flushed(1, 10)
+	p.publish()
+	assert.Len(t, client.inputs, 2)
+	assert.Equal(t, float64(1), aws.Float64Value(client.inputs[1].MetricData[0].Value))
+	assert.Equal(t, float64(0), aws.Float64Value(client.inputs[1].MetricData[2].Value))
+	assert.Equal(t, float64(1), aws.Float64Value(client.inputs[1].MetricData[4].Value))
+	assert.Equal(t, float64(0), aws.Float64Value(client.inputs[1].MetricData[8].Value))
+}
+
+func TestCloudWatchPublisher_Batches(t *testing.T) {
+	streams := make(map[string]*Stream)
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("stream%03d", i)
+		streams[name] = NewStream(StreamSpec{Name: name}, &Config{Client: &fakeClient{}})
+	}
+
+	client := &fakeMetricsClient{}
+	testPublisher(client, streams).publish()
+
+	assert.Len(t, client.inputs, 2)
+	assert.Len(t, client.inputs[0].MetricData, MetricDataPerRequest)
+	assert.Len(t, client.inputs[1].MetricData, 200)
+}
+
+func TestCloudWatchPublisher_Error(t *testing.T) {
+	var reported error
+	ErrorHandler = func(err error) {
+		if err != nil {
+			reported = err
+		}
+	}
+	defer func() { ErrorHandler = logErr }()
+
+	s := NewStream(StreamSpec{Name: "abc"}, &Config{Client: &fakeClient{}})
+	client := &fakeMetricsClient{err: errors.New("throttled")}
+	testPublisher(client, map[string]*Stream{"abc": s}).publish()
+
+	assert.IsType(t, &PublishMetricsError{}, reported)
+	assert.Equal(t, 4, reported.(*PublishMetricsError).Count)
+}
+
+func TestCloudWatchConfig(t *testing.T) {
+	sess := session.New(&aws.Config{Region: aws.String("us-east-1")})
+
+	config, err := cloudWatchConfig(&router.Route{}, sess)
+	assert.Nil(t, err)
+	assert.Nil(t, config)
+
+	config, err = cloudWatchConfig(&router.Route{Options: map[string]string{
+		"cloudwatch_namespace":  "Logspout",
+		"cloudwatch_interval":   "10s",
+		"cloudwatch_dimensions": `app={{ label .Container "app" }};host={{ .Container.Config.Hostname }}`,
+	}}, sess)
+	assert.Nil(t, err)
+	assert.Equal(t, "Logspout", config.Namespace)
+	assert.Equal(t, 10*time.Second, config.Interval)
+	assert.Len(t, config.DimensionTmpls, 2)
+
+	m := &router.Message{Container: &docker.Container{Config: &docker.Config{Hostname: "h1"}}}
+	assert.Equal(t, map[string]string{"host": "h1"}, streamDimensions(config, "abc", m, false))
+
+	// A dimension that can't be rendered is reported and skipped.
+	var reported error
+	ErrorHandler = func(err error) { reported = err }
+	defer func() { ErrorHandler = logErr }()
+
+	config.DimensionTmpls["team"], _ = parseTmpl(`{{ label .Container "team" }}`, "missingkey=error")
+	assert.Equal(t, map[string]string{"host": "h1"}, streamDimensions(config, "abc", m, false))
+	assert.IsType(t, &DimensionError{}, reported)
+
+	_, err = cloudWatchConfig(&router.Route{Options: map[string]string{
+		"cloudwatch_namespace":  "Logspout",
+		"cloudwatch_dimensions": "app",
+	}}, sess)
+	assert.IsType(t, &InvalidDimensionError{}, err)
+}
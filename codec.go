@@ -0,0 +1,137 @@
+package kinesis
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// NoCompression leaves the records data uncompressed.
+	NoCompression = "none"
+
+	// GzipCompression compresses the records data with gzip.
+	GzipCompression = "gzip"
+
+	// ZstdCompression compresses the records data with zstd.
+	ZstdCompression = "zstd"
+
+	// SnappyCompression compresses the records data with the snappy block
+	// format.
+	SnappyCompression = "snappy"
+)
+
+// UnknownCompressionError is returned when the compression codec isn't
+// supported.
+type UnknownCompressionError struct {
+	Compression string
+}
+
+func (e *UnknownCompressionError) Error() string {
+	return fmt.Sprintf("unknown compression: %s", e.Compression)
+}
+
+// EncodeError is returned when an aggregated record couldn't be compressed,
+// and its user records are dropped.
+type EncodeError struct {
+	Stream string
+	Count  int
+	Err    error
+}
+
+func (e *EncodeError) Error() string {
+	return fmt.Sprintf("couldn't encode the aggregated record, records dropped! stream: %s, # items: %d, %v", e.Stream, e.Count, e.Err)
+}
+
+// Codec compresses the records data.
+type Codec interface {
+	// Marker is the byte prefixing the compressed data, when markers are
+	// enabled, so consumers know which codec to use.
+	Marker() byte
+
+	Encode(data []byte) ([]byte, error)
+
+	// MaxEncodedLen returns the maximum length of n bytes once encoded.
+	MaxEncodedLen(n int) int
+}
+
+// NewCodec returns the codec for the given compression, or nil if the
+// records shouldn't be compressed.
+func NewCodec(compression string) (Codec, error) {
+	switch compression {
+	case "", NoCompression:
+		return nil, nil
+	case GzipCompression:
+		return &gzipCodec{}, nil
+	case ZstdCompression:
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		return &zstdCodec{encoder: enc}, nil
+	case SnappyCompression:
+		return &snappyCodec{}, nil
+	default:
+		return nil, &UnknownCompressionError{Compression: compression}
+	}
+}
+
+type gzipCodec struct{}
+
+func (c *gzipCodec) Marker() byte {
+	return 1
+}
+
+func (c *gzipCodec) Encode(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// MaxEncodedLen accounts for the gzip header and trailer, and the deflate
+// stored blocks overhead.
+func (c *gzipCodec) MaxEncodedLen(n int) int {
+	return n + 5*(n/16383+1) + 18
+}
+
+type zstdCodec struct {
+	encoder *zstd.Encoder
+}
+
+func (c *zstdCodec) Marker() byte {
+	return 2
+}
+
+func (c *zstdCodec) Encode(data []byte) ([]byte, error) {
+	return c.encoder.EncodeAll(data, nil), nil
+}
+
+// MaxEncodedLen follows ZSTD_COMPRESSBOUND, with some room for the frame
+// header.
+func (c *zstdCodec) MaxEncodedLen(n int) int {
+	return n + n>>8 + 64
+}
+
+type snappyCodec struct{}
+
+func (c *snappyCodec) Marker() byte {
+	return 3
+}
+
+func (c *snappyCodec) Encode(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (c *snappyCodec) MaxEncodedLen(n int) int {
+	return snappy.MaxEncodedLen(n)
+}
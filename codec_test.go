@@ -0,0 +1,95 @@
+package kinesis
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+var codecTestData = []byte(strings.Repeat("hello world ", 100))
+
+func TestCodec_None(t *testing.T) {
+	c, err := NewCodec(NoCompression)
+	assert.Nil(t, err)
+	assert.Nil(t, c)
+}
+
+func TestCodec_Gzip(t *testing.T) {
+	c, err := NewCodec(GzipCompression)
+	assert.Nil(t, err)
+
+	encoded, err := c.Encode(codecTestData)
+	assert.Nil(t, err)
+	assert.True(t, len(encoded) <= c.MaxEncodedLen(len(codecTestData)))
+
+	r, err := gzip.NewReader(bytes.NewReader(encoded))
+	assert.Nil(t, err)
+	decoded, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, codecTestData, decoded)
+}
+
+func TestCodec_Zstd(t *testing.T) {
+	c, err := NewCodec(ZstdCompression)
+	assert.Nil(t, err)
+
+	encoded, err := c.Encode(codecTestData)
+	assert.Nil(t, err)
+	assert.True(t, len(encoded) <= c.MaxEncodedLen(len(codecTestData)))
+
+	d, err := zstd.NewReader(nil)
+	assert.Nil(t, err)
+	decoded, err := d.DecodeAll(encoded, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, codecTestData, decoded)
+}
+
+func TestCodec_Snappy(t *testing.T) {
+	c, err := NewCodec(SnappyCompression)
+	assert.Nil(t, err)
+
+	encoded, err := c.Encode(codecTestData)
+	assert.Nil(t, err)
+
+	decoded, err := snappy.Decode(nil, encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, codecTestData, decoded)
+}
+
+func TestCodec_Unknown(t *testing.T) {
+	_, err := NewCodec("lz4")
+	assert.Equal(t, &UnknownCompressionError{Compression: "lz4"}, err)
+}
+
+func TestBuffer_CompressWithMarker(t *testing.T) {
+	tmpl, _ := template.New("").Parse("abc")
+	b := newBuffer(&Config{
+		PKeyTmpl:    tmpl,
+		Codec:       &snappyCodec{},
+		CodecMarker: true,
+	}, "abc")
+
+	m := &router.Message{
+		Data: string(codecTestData),
+		Container: &docker.Container{
+			ID: "123",
+		},
+	}
+
+	e, err := b.entry(m)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(3), e.Data[0])
+
+	decoded, err := snappy.Decode(nil, e.Data[1:])
+	assert.Nil(t, err)
+	assert.Equal(t, codecTestData, decoded)
+}
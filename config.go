@@ -0,0 +1,98 @@
+package kinesis
+
+import (
+	"text/template"
+	"time"
+)
+
+// Config holds the settings shared by the streams of an adapter.
+type Config struct {
+	// Debug prints the debug logs of the adapter.
+	Debug bool
+
+	// Client is shared by all the streams. Nil creates a client with the
+	// AWS SDK defaults for each stream.
+	Client Client
+
+	// PKeyTmpl is the template of the records partition key.
+	PKeyTmpl *template.Template
+
+	// Formatter encodes the messages into the records data.
+	Formatter Formatter
+
+	// TmplOptions are the options of the templates of the container labels,
+	// e.g. missingkey=error.
+	TmplOptions []string
+
+	// RecordLabels and RecordEnv are the container labels and environment
+	// variables of the JSON records, for the containers overriding the
+	// format.
+	RecordLabels []string
+	RecordEnv    []string
+
+	// Aggregate packs the records using the KPL aggregated record format.
+	Aggregate bool
+
+	// Codec compresses the records data, or the aggregated records data when
+	// aggregating. Nil leaves the data uncompressed.
+	Codec Codec
+
+	// CodecMarker prefixes the compressed data with the codec marker byte.
+	CodecMarker bool
+
+	// Firehose sends the records to Firehose delivery streams instead of
+	// Kinesis streams when set.
+	Firehose *FirehoseConfig
+
+	// PendingLimit and PendingSizeLimit bound the number and size of the
+	// messages held while a stream isn't ready. Zero uses the defaults.
+	PendingLimit     int
+	PendingSizeLimit int
+
+	// RetryLimit is the number of attempts made to send the records. Zero
+	// uses the default.
+	RetryLimit int
+
+	// ReadyTimeout bounds the wait for a stream to become active, and
+	// RetryInterval is the wait before retrying a stream that failed.
+	// Zero uses the defaults.
+	ReadyTimeout  time.Duration
+	RetryInterval time.Duration
+
+	// SkipCreate only checks the streams exist and are active, instead of
+	// creating them.
+	SkipCreate bool
+
+	// SkipTag doesn't tag the streams.
+	SkipTag bool
+
+	// SkipRetag only tags the streams created by the adapter, leaving the
+	// tags of the existing streams untouched.
+	SkipRetag bool
+
+	// OnDemand creates the streams in the on-demand capacity mode, instead
+	// of with a number of shards.
+	OnDemand bool
+
+	// RequireEncryption refuses to write to the streams that aren't
+	// encrypted with KMS.
+	RequireEncryption bool
+
+	// Reshard updates the shard count of the streams created by the adapter,
+	// tagged with ManagedTagKey, from their throughput when set.
+	Reshard *ReshardConfig
+
+	// CloudWatch publishes the counters of the streams to CloudWatch when
+	// set.
+	CloudWatch *CloudWatchConfig
+
+	// Spool keeps on disk the inputs that can't be queued or sent, and
+	// replays them, when set.
+	Spool *SpoolConfig
+
+	// QueueDepth is the number of inputs a flusher queues while sending one,
+	// and BlockTimeout the maximum wait for room in the queue with the block
+	// backpressure policy, zero using DefaultBlockTimeout.
+	QueueDepth   int
+	BlockTimeout time.Duration
+}
@@ -0,0 +1,96 @@
+package kinesis
+
+import (
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+)
+
+func init() {
+	router.Jobs.Register(&eventsJob{}, "kinesis-events")
+}
+
+// containerExits notifies the adapters of the containers that died or were
+// destroyed, so they can evict their writers.
+var containerExits = &exitNotifier{
+	subs: make(map[chan string]struct{}),
+}
+
+type exitNotifier struct {
+	sync.Mutex
+	subs map[chan string]struct{}
+}
+
+func (n *exitNotifier) subscribe() chan string {
+	n.Lock()
+	defer n.Unlock()
+
+	c := make(chan string, 100)
+	n.subs[c] = struct{}{}
+	return c
+}
+
+func (n *exitNotifier) unsubscribe(c chan string) {
+	n.Lock()
+	defer n.Unlock()
+
+	delete(n.subs, c)
+}
+
+// publish sends the container ID to the subscribers, without blocking on
+// the busy ones: their idle writers will be evicted anyway.
+func (n *exitNotifier) publish(id string) {
+	n.Lock()
+	defer n.Unlock()
+
+	for c := range n.subs {
+		select {
+		case c <- id:
+		default:
+			debug("exit notification dropped, container: %s", id)
+		}
+	}
+}
+
+// eventsJob listens to the Docker events for the containers exits.
+type eventsJob struct {
+	client *docker.Client
+}
+
+func (j *eventsJob) Name() string {
+	return "kinesis-events"
+}
+
+func (j *eventsJob) Setup() error {
+	endpoint := os.Getenv("DOCKER_HOST")
+	if endpoint == "" {
+		endpoint = "unix:///var/run/docker.sock"
+	}
+
+	client, err := docker.NewClient(endpoint)
+	if err != nil {
+		return err
+	}
+
+	j.client = client
+	return nil
+}
+
+func (j *eventsJob) Run() error {
+	events := make(chan *docker.APIEvents)
+	if err := j.client.AddEventListener(events); err != nil {
+		return err
+	}
+
+	for event := range events {
+		switch event.Status {
+		case "die", "destroy":
+			containerExits.publish(event.ID)
+		}
+	}
+
+	return errors.New("docker event stream closed")
+}
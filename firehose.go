@@ -0,0 +1,201 @@
+package kinesis
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/gliderlabs/logspout/router"
+)
+
+const (
+	// PutRecordBatchLimit is the maximum number of records allowed for a
+	// Firehose PutRecordBatch request.
+	PutRecordBatchLimit int = 500
+
+	// PutRecordBatchSizeLimit is the maximum allowed size per Firehose
+	// PutRecordBatch request.
+	PutRecordBatchSizeLimit int = 4 * 1024 * 1024 // 4MiB
+
+	// FirehoseRecordSizeLimit is the maximum allowed size per Firehose record.
+	FirehoseRecordSizeLimit int = 1000 * 1024 // 1000KiB
+)
+
+// ErrFirehoseUnsupported is returned by the Kinesis operations that don't
+// apply to the delivery streams, e.g. resharding.
+var ErrFirehoseUnsupported = errors.New("unsupported by firehose delivery streams")
+
+// FirehoseConfig holds the settings of the Firehose delivery streams.
+type FirehoseConfig struct {
+	// RoleARN is the role Firehose assumes to deliver to the S3 bucket of
+	// the delivery streams it creates.
+	RoleARN string
+
+	// BucketARN is the S3 bucket of the delivery streams it creates.
+	BucketARN string
+}
+
+// NewFirehoseAdapter creates a Kinesis Data Firehose adapter. Called during
+// init.
+func NewFirehoseAdapter(route *router.Route) (router.LogAdapter, error) {
+	config, err := firehoseConfig(route)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAdapter(route, config)
+}
+
+// firehoseConfig reads the Firehose settings of the route. The role and the
+// bucket are required to create the delivery streams.
+func firehoseConfig(route *router.Route) (*FirehoseConfig, error) {
+	config := &FirehoseConfig{
+		RoleARN:   routeOpt(route, "KINESIS_FIREHOSE_ROLE_ARN"),
+		BucketARN: routeOpt(route, "KINESIS_FIREHOSE_BUCKET_ARN"),
+	}
+
+	if routeOpt(route, "KINESIS_STREAM_CREATE") != "false" {
+		if config.RoleARN == "" {
+			return nil, &MissingEnvVarError{EnvVar: "KINESIS_FIREHOSE_ROLE_ARN"}
+		}
+		if config.BucketARN == "" {
+			return nil, &MissingEnvVarError{EnvVar: "KINESIS_FIREHOSE_BUCKET_ARN"}
+		}
+	}
+
+	return config, nil
+}
+
+// firehoseClient implements the Client interface for Firehose delivery
+// streams, translating the Kinesis inputs and outputs.
+type firehoseClient struct {
+	firehose *firehose.Firehose
+	config   *FirehoseConfig
+}
+
+func (c *firehoseClient) Create(input *kinesis.CreateStreamInput) (bool, error) {
+	_, err := c.firehose.CreateDeliveryStream(&firehose.CreateDeliveryStreamInput{
+		DeliveryStreamName: input.StreamName,
+		DeliveryStreamType: aws.String(firehose.DeliveryStreamTypeDirectPut),
+		ExtendedS3DestinationConfiguration: &firehose.ExtendedS3DestinationConfiguration{
+			RoleARN:   aws.String(c.config.RoleARN),
+			BucketARN: aws.String(c.config.BucketARN),
+		},
+	})
+
+	if err != nil {
+		if reqErr, ok := err.(awserr.Error); ok {
+			if reqErr.Code() == firehose.ErrCodeResourceInUseException {
+				return true, nil
+			}
+			return false, err
+		}
+		return false, err
+	}
+
+	return false, nil
+}
+
+func (c *firehoseClient) Status(input *kinesis.DescribeStreamInput) (string, error) {
+	resp, err := c.firehose.DescribeDeliveryStream(&firehose.DescribeDeliveryStreamInput{
+		DeliveryStreamName: input.StreamName,
+	})
+	if err != nil {
+		return "", &DescribeStreamError{
+			Stream: aws.StringValue(input.StreamName),
+			Err:    err,
+		}
+	}
+
+	if resp.DeliveryStreamDescription == nil {
+		return "", &DescribeStreamError{
+			Stream: aws.StringValue(input.StreamName),
+			Err:    errors.New("missing delivery stream description"),
+		}
+	}
+
+	return aws.StringValue(resp.DeliveryStreamDescription.DeliveryStreamStatus), nil
+}
+
+func (c *firehoseClient) Tag(input *kinesis.AddTagsToStreamInput) error {
+	tags := make([]*firehose.Tag, 0, len(input.Tags))
+	for k, v := range input.Tags {
+		tags = append(tags, &firehose.Tag{
+			Key:   aws.String(k),
+			Value: v,
+		})
+	}
+
+	_, err := c.firehose.TagDeliveryStream(&firehose.TagDeliveryStreamInput{
+		DeliveryStreamName: input.StreamName,
+		Tags:               tags,
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Tags isn't supported, the delivery streams are never resharded.
+func (c *firehoseClient) Tags(input *kinesis.ListTagsForStreamInput) (map[string]string, error) {
+	return nil, ErrFirehoseUnsupported
+}
+
+// Reshard isn't supported, the delivery streams scale on their own.
+func (c *firehoseClient) Reshard(input *kinesis.UpdateShardCountInput) error {
+	return ErrFirehoseUnsupported
+}
+
+// Shards isn't supported, the delivery streams have no shards.
+func (c *firehoseClient) Shards(input *kinesis.DescribeStreamSummaryInput) (int64, error) {
+	return 0, ErrFirehoseUnsupported
+}
+
+// Encryption isn't supported, the delivery streams are never encrypted by
+// the adapter.
+func (c *firehoseClient) Encryption(input *kinesis.DescribeStreamInput) (string, string, error) {
+	return "", "", ErrFirehoseUnsupported
+}
+
+func (c *firehoseClient) Encrypt(input *kinesis.StartStreamEncryptionInput) error {
+	return ErrFirehoseUnsupported
+}
+
+func (c *firehoseClient) PutRecords(inp *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	out, err := c.firehose.PutRecordBatch(putRecordBatchInput(inp))
+	if err != nil {
+		return nil, err
+	}
+
+	return putRecordsOutput(out), nil
+}
+
+func putRecordBatchInput(inp *kinesis.PutRecordsInput) *firehose.PutRecordBatchInput {
+	records := make([]*firehose.Record, 0, len(inp.Records))
+	for _, r := range inp.Records {
+		records = append(records, &firehose.Record{Data: r.Data})
+	}
+
+	return &firehose.PutRecordBatchInput{
+		DeliveryStreamName: inp.StreamName,
+		Records:            records,
+	}
+}
+
+func putRecordsOutput(out *firehose.PutRecordBatchOutput) *kinesis.PutRecordsOutput {
+	records := make([]*kinesis.PutRecordsResultEntry, 0, len(out.RequestResponses))
+	for _, r := range out.RequestResponses {
+		records = append(records, &kinesis.PutRecordsResultEntry{
+			ErrorCode:    r.ErrorCode,
+			ErrorMessage: r.ErrorMessage,
+		})
+	}
+
+	return &kinesis.PutRecordsOutput{
+		FailedRecordCount: out.FailedPutCount,
+		Records:           records,
+	}
+}
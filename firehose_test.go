@@ -0,0 +1,74 @@
+package kinesis
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFirehose_PutRecordBatchInput(t *testing.T) {
+	inp := putRecordBatchInput(testInput("a", "b"))
+
+	assert.Equal(t, "abc", *inp.DeliveryStreamName)
+	assert.Equal(t, []*firehose.Record{
+		{Data: []byte("a")},
+		{Data: []byte("b")},
+	}, inp.Records)
+}
+
+func TestFirehose_PutRecordsOutput(t *testing.T) {
+	out := putRecordsOutput(&firehose.PutRecordBatchOutput{
+		FailedPutCount: aws.Int64(1),
+		RequestResponses: []*firehose.PutRecordBatchResponseEntry{
+			{RecordId: aws.String("1")},
+			{ErrorCode: aws.String("ServiceUnavailableException")},
+		},
+	})
+
+	assert.Equal(t, int64(1), *out.FailedRecordCount)
+	assert.Equal(t, []*kinesis.PutRecordsResultEntry{
+		{},
+		{ErrorCode: aws.String("ServiceUnavailableException")},
+	}, out.Records)
+}
+
+func TestFirehose_BufferWithoutPartitionKey(t *testing.T) {
+	b := newBuffer(&Config{Firehose: &FirehoseConfig{}}, "abc")
+
+	m := &router.Message{
+		Data: "hello",
+		Container: &docker.Container{
+			ID: "123",
+		},
+	}
+
+	e, err := b.entry(m)
+	assert.Nil(t, err)
+	assert.Equal(t, "", *e.PartitionKey)
+	assert.Equal(t, PutRecordBatchLimit, b.limits.putRecords)
+	assert.Equal(t, PutRecordBatchSizeLimit, b.limits.putRecordsSize)
+}
+
+func TestFirehoseConfig(t *testing.T) {
+	_, err := firehoseConfig(&router.Route{})
+	assert.Equal(t, &MissingEnvVarError{EnvVar: "KINESIS_FIREHOSE_ROLE_ARN"}, err)
+
+	_, err = firehoseConfig(&router.Route{Options: map[string]string{"firehose_role_arn": "role"}})
+	assert.Equal(t, &MissingEnvVarError{EnvVar: "KINESIS_FIREHOSE_BUCKET_ARN"}, err)
+
+	config, err := firehoseConfig(&router.Route{Options: map[string]string{
+		"firehose_role_arn":   "role",
+		"firehose_bucket_arn": "bucket",
+	}})
+	assert.Nil(t, err)
+	assert.Equal(t, "bucket", config.BucketARN)
+
+	// The delivery streams managed elsewhere don't need them.
+	_, err = firehoseConfig(&router.Route{Options: map[string]string{"stream_create": "false"}})
+	assert.Nil(t, err)
+}
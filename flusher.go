@@ -2,10 +2,26 @@ package kinesis
 
 import (
 	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 )
 
+const (
+	// DefaultRetryLimit is the default number of attempts made to send the
+	// records of a PutRecords request before giving up on them.
+	DefaultRetryLimit int = 5
+
+	retryBaseDelay = 100 * time.Millisecond
+	retryMaxDelay  = 5 * time.Second
+)
+
 // DroppedInputError is returned when an input is dropped.
 type DroppedInputError struct {
 	Stream string
@@ -16,51 +32,357 @@ func (e *DroppedInputError) Error() string {
 	return fmt.Sprintf("input dropped! stream: %s, # items: %d", e.Stream, e.Count)
 }
 
+// FailedRecordsError is returned when records are still rejected by Kinesis
+// after all the retries.
+type FailedRecordsError struct {
+	Stream string
+	Count  int
+	// Reasons counts the failed records by error code.
+	Reasons map[string]int
+}
+
+func (e *FailedRecordsError) Error() string {
+	codes := make([]string, 0, len(e.Reasons))
+	for code := range e.Reasons {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	reasons := make([]string, 0, len(codes))
+	for _, code := range codes {
+		reasons = append(reasons, fmt.Sprintf("%s: %d", code, e.Reasons[code]))
+	}
+
+	return fmt.Sprintf("records failed! stream: %s, # items: %d, reasons: %s",
+		e.Stream, e.Count, strings.Join(reasons, ", "))
+}
+
 // Flusher flushes the inputs to Amazon Kinesis.
 type Flusher interface {
 	start()
 	flush(input kinesis.PutRecordsInput)
 	flushInputs()
+
+	// stop stops accepting inputs, the queued inputs are still sent.
+	stop()
+
+	// done is closed once all the inputs are sent after stop.
+	done() <-chan struct{}
+
+	// pending returns the number of records queued or being sent.
+	pending() int
+
+	// queued returns the number of inputs queued.
+	queued() int
+
+	// lastError returns the error of the last PutRecords request, if it
+	// failed.
+	lastError() error
+
+	// lastFlush returns when Kinesis last accepted the records of an input.
+	lastFlush() time.Time
 }
 
 type flusher struct {
 	client        Client
 	inputs        chan kinesis.PutRecordsInput
 	dropInputFunc func(kinesis.PutRecordsInput)
+	retryLimit    int
+	backoffFunc   func(attempt int) time.Duration
+	pendingCount  int64
+	flushed       chan struct{}
+	metrics       *streamMetrics
+	resultMutex   sync.Mutex
+	lastErr       error
+	flushedAt     time.Time
+
+	// policy tells what to do with an input when the queue is full.
+	policy       BackpressurePolicy
+	blockTimeout time.Duration
+
+	// spool takes the inputs that can't be queued or sent when set.
+	spool *spool
+
+	debug debugLogger
+}
+
+// flusherConfig holds the settings of a flusher, zero values use the
+// defaults.
+type flusherConfig struct {
+	retryLimit   int
+	queueDepth   int
+	policy       BackpressurePolicy
+	blockTimeout time.Duration
+	metrics      *streamMetrics
+	spool        *spool
+	debug        debugLogger
 }
 
-func newFlusher(client Client) Flusher {
+func newFlusher(client Client, config flusherConfig) Flusher {
+	if config.retryLimit <= 0 {
+		config.retryLimit = DefaultRetryLimit
+	}
+	if config.queueDepth <= 0 {
+		config.queueDepth = DefaultQueueDepth
+	}
+	if config.policy == "" {
+		config.policy = DropNewest
+	}
+	if config.blockTimeout <= 0 {
+		config.blockTimeout = DefaultBlockTimeout
+	}
+
 	return &flusher{
 		client:        client,
-		inputs:        make(chan kinesis.PutRecordsInput, 10),
+		inputs:        make(chan kinesis.PutRecordsInput, config.queueDepth),
 		dropInputFunc: dropInput,
+		retryLimit:    config.retryLimit,
+		backoffFunc:   backoff,
+		flushed:       make(chan struct{}),
+		metrics:       config.metrics,
+		policy:        config.policy,
+		blockTimeout:  config.blockTimeout,
+		spool:         config.spool,
+		debug:         config.debug,
 	}
 }
 
 func (f *flusher) start() {
 	f.flushInputs()
+	close(f.flushed)
+}
+
+func (f *flusher) stop() {
+	close(f.inputs)
+}
+
+func (f *flusher) done() <-chan struct{} {
+	return f.flushed
+}
+
+func (f *flusher) pending() int {
+	return int(atomic.LoadInt64(&f.pendingCount))
+}
+
+func (f *flusher) queued() int {
+	return len(f.inputs)
+}
+
+func (f *flusher) lastError() error {
+	f.resultMutex.Lock()
+	defer f.resultMutex.Unlock()
+
+	return f.lastErr
+}
+
+func (f *flusher) lastFlush() time.Time {
+	f.resultMutex.Lock()
+	defer f.resultMutex.Unlock()
+
+	return f.flushedAt
 }
 
+// flush queues the input, applying the backpressure policy when the queue is
+// full.
 func (f *flusher) flush(input kinesis.PutRecordsInput) {
+	// The inputs follow the ones spooled until they're replayed.
+	if f.spool != nil && !f.spool.empty() {
+		f.spoolInput(&input)
+		return
+	}
+
+	count := int64(len(input.Records))
+	atomic.AddInt64(&f.pendingCount, count)
+
 	select {
 	case f.inputs <- input:
+		return
 	default:
-		f.dropInputFunc(input)
+	}
+
+	switch f.policy {
+	case DropOldest:
+		for {
+			select {
+			case f.inputs <- input:
+				return
+			case old := <-f.inputs:
+				f.drop(old)
+			}
+		}
+	case Block:
+		if f.block(input) {
+			return
+		}
+	case Spill:
+		if f.spool != nil {
+			atomic.AddInt64(&f.pendingCount, -count)
+			f.spoolInput(&input)
+			return
+		}
+	}
+
+	f.drop(input)
+}
+
+// block waits for room in the queue until the block timeout, the default one
+// if it's zero, and tells if the input was queued.
+func (f *flusher) block(input kinesis.PutRecordsInput) bool {
+	f.debug.printf("queue full, blocking. stream: %s", *input.StreamName)
+
+	timeout := f.blockTimeout
+	if timeout <= 0 {
+		timeout = DefaultBlockTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case f.inputs <- input:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// drop drops an input counted as pending.
+func (f *flusher) drop(input kinesis.PutRecordsInput) {
+	atomic.AddInt64(&f.pendingCount, -int64(len(input.Records)))
+	f.metrics.dropped(len(input.Records))
+	f.dropInputFunc(input)
+}
+
+// spoolInput writes the input to the spool, or drops it if it can't.
+func (f *flusher) spoolInput(input *kinesis.PutRecordsInput) {
+	if spoolInput(f.spool, f.metrics, input) {
+		f.debug.printf("input spooled, stream: %s, # items: %d", *input.StreamName, len(input.Records))
 	}
 }
 
 func (f *flusher) flushInputs() {
 	for inp := range f.inputs {
-		_, err := f.client.PutRecords(&inp)
+		f.flushInput(&inp)
+		atomic.AddInt64(&f.pendingCount, -int64(len(inp.Records)))
+	}
+}
+
+// flushInput sends a queued input. The records that couldn't be sent are
+// spooled to be replayed if the stream spills, or counted as failed
+// otherwise.
+func (f *flusher) flushInput(inp *kinesis.PutRecordsInput) {
+	// The inputs queued after a spooled one follow it, to keep their order.
+	if f.spool != nil && !f.spool.empty() {
+		f.spoolInput(inp)
+		return
+	}
+
+	failed, err := f.putRecords(inp)
+
+	f.resultMutex.Lock()
+	f.lastErr = err
+	if err == nil {
+		f.flushedAt = time.Now()
+	}
+	f.resultMutex.Unlock()
+
+	if err != nil {
+		if f.spool != nil {
+			f.debug.printf("records failed, spooling. stream: %s, # items: %d, %v",
+				*inp.StreamName, len(failed.Records), err)
+			f.spoolInput(failed)
+			return
+		}
+
+		f.metrics.failed(len(failed.Records))
+		ErrorHandler(err)
+	}
+
+	f.debug.printf("buffer flushed, stream: %s, length: %d",
+		*inp.StreamName, len(inp.Records))
+}
+
+// putRecords sends the input to Kinesis, and resends the records rejected
+// by Kinesis until they all succeed or the retry limit is reached. On error,
+// it returns the records that couldn't be sent.
+func (f *flusher) putRecords(inp *kinesis.PutRecordsInput) (*kinesis.PutRecordsInput, error) {
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		out, err := f.client.PutRecords(inp)
+		f.metrics.observeLatency(time.Since(start))
 		if err != nil {
-			ErrorHandler(err)
+			return inp, err
+		}
+
+		if out == nil || aws.Int64Value(out.FailedRecordCount) == 0 {
+			f.metrics.flushed(len(inp.Records), inputSize(inp))
+			return nil, nil
 		}
 
-		debug("buffer flushed, stream: %s, length: %d",
-			*inp.StreamName, len(inp.Records))
+		failed, reasons := failedRecords(inp, out)
+		f.metrics.flushed(len(inp.Records)-len(failed.Records), inputSize(inp)-inputSize(failed))
+
+		if attempt >= f.retryLimit {
+			return failed, &FailedRecordsError{
+				Stream:  *inp.StreamName,
+				Count:   len(failed.Records),
+				Reasons: reasons,
+			}
+		}
+
+		f.metrics.retried(len(failed.Records))
+		f.debug.printf("records failed, stream: %s, # items: %d, attempt: %d",
+			*inp.StreamName, len(failed.Records), attempt)
+
+		time.Sleep(f.backoffFunc(attempt))
+		inp = failed
 	}
 }
 
+// failedRecords builds a new input with the records Kinesis rejected, and
+// counts the rejections by error code.
+func failedRecords(inp *kinesis.PutRecordsInput, out *kinesis.PutRecordsOutput) (*kinesis.PutRecordsInput, map[string]int) {
+	failed := &kinesis.PutRecordsInput{
+		StreamName: inp.StreamName,
+		Records:    make([]*kinesis.PutRecordsRequestEntry, 0),
+	}
+	reasons := make(map[string]int)
+
+	for i, res := range out.Records {
+		if res.ErrorCode == nil || i >= len(inp.Records) {
+			continue
+		}
+
+		failed.Records = append(failed.Records, inp.Records[i])
+		reasons[*res.ErrorCode]++
+	}
+
+	return failed, reasons
+}
+
+// inputSize returns the size of the records of the input.
+func inputSize(inp *kinesis.PutRecordsInput) int {
+	size := 0
+	for _, e := range inp.Records {
+		size += entrySize(e)
+	}
+
+	return size
+}
+
+// backoff returns a jittered exponential delay for the given attempt.
+func backoff(attempt int) time.Duration {
+	return jitteredBackoff(retryBaseDelay, retryMaxDelay, attempt)
+}
+
+func jitteredBackoff(base, max time.Duration, attempt int) time.Duration {
+	d := base << uint(attempt-1)
+	if d <= 0 || d > max {
+		d = max
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
 func dropInput(input kinesis.PutRecordsInput) {
 	ErrorHandler(&DroppedInputError{
 		Stream: *input.StreamName,
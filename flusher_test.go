@@ -9,8 +9,46 @@ import (
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/fsouza/go-dockerclient"
 	"github.com/gliderlabs/logspout/router"
+	"github.com/stretchr/testify/assert"
 )
 
+type retryClient struct {
+	fakeClient
+	outputs []*kinesis.PutRecordsOutput
+	inputs  []*kinesis.PutRecordsInput
+}
+
+func (c *retryClient) PutRecords(inp *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.inputs = append(c.inputs, inp)
+	out := c.outputs[0]
+	if len(c.outputs) > 1 {
+		c.outputs = c.outputs[1:]
+	}
+
+	return out, nil
+}
+
+func testInput(data ...string) *kinesis.PutRecordsInput {
+	inp := &kinesis.PutRecordsInput{
+		StreamName: aws.String("abc"),
+	}
+	for _, d := range data {
+		inp.Records = append(inp.Records, &kinesis.PutRecordsRequestEntry{
+			Data:         []byte(d),
+			PartitionKey: aws.String("key"),
+		})
+	}
+
+	return inp
+}
+
+func noBackoff(attempt int) time.Duration {
+	return 0
+}
+
 func TestFlusher_FlushFull(t *testing.T) {
 	drop := make(chan struct{})
 	f := &flusher{
@@ -57,10 +95,10 @@ func TestFlusher_IntegrationInputsChannelFull(t *testing.T) {
 		},
 	}
 
-	s := NewStream(streamName, &tags, tmpl)
+	s := NewStream(StreamSpec{Name: streamName, Tags: &tags}, &Config{PKeyTmpl: tmpl})
 
 	w := newWriter(
-		newBuffer(tmpl, streamName),
+		newBuffer(&Config{PKeyTmpl: tmpl}, streamName),
 		f,
 	)
 	w.ticker = nil
@@ -69,6 +107,7 @@ func TestFlusher_IntegrationInputsChannelFull(t *testing.T) {
 	s.writers[m.Container.ID] = w
 	s.client = &fakeClient{
 		created: true,
+		status:  "ACTIVE",
 		err:     nil,
 	}
 
@@ -91,3 +130,125 @@ func TestFlusher_IntegrationInputsChannelFull(t *testing.T) {
 		t.Fatal("Expected input to be dropped")
 	}
 }
+
+func TestFlusher_RetryFailedRecords(t *testing.T) {
+	c := &retryClient{
+		outputs: []*kinesis.PutRecordsOutput{
+			{
+				FailedRecordCount: aws.Int64(1),
+				Records: []*kinesis.PutRecordsResultEntry{
+					{SequenceNumber: aws.String("1")},
+					{ErrorCode: aws.String("ProvisionedThroughputExceededException")},
+					{SequenceNumber: aws.String("3")},
+				},
+			},
+			{
+				FailedRecordCount: aws.Int64(0),
+				Records: []*kinesis.PutRecordsResultEntry{
+					{SequenceNumber: aws.String("2")},
+				},
+			},
+		},
+	}
+	f := &flusher{
+		client:      c,
+		retryLimit:  DefaultRetryLimit,
+		backoffFunc: noBackoff,
+	}
+
+	_, err := f.putRecords(testInput("a", "b", "c"))
+	assert.Nil(t, err)
+
+	if assert.Len(t, c.inputs, 2) {
+		assert.Len(t, c.inputs[1].Records, 1)
+		assert.Equal(t, []byte("b"), c.inputs[1].Records[0].Data)
+	}
+}
+
+func TestFlusher_RetryLimitReached(t *testing.T) {
+	c := &retryClient{
+		outputs: []*kinesis.PutRecordsOutput{
+			{
+				FailedRecordCount: aws.Int64(2),
+				Records: []*kinesis.PutRecordsResultEntry{
+					{ErrorCode: aws.String("ProvisionedThroughputExceededException")},
+					{ErrorCode: aws.String("InternalFailure")},
+				},
+			},
+		},
+	}
+	f := &flusher{
+		client:      c,
+		retryLimit:  3,
+		backoffFunc: noBackoff,
+	}
+
+	_, err := f.putRecords(testInput("a", "b"))
+	assert.Equal(t, &FailedRecordsError{
+		Stream: "abc",
+		Count:  2,
+		Reasons: map[string]int{
+			"ProvisionedThroughputExceededException": 1,
+			"InternalFailure":                        1,
+		},
+	}, err)
+	assert.Len(t, c.inputs, 3)
+}
+
+func TestFlusher_LastResult(t *testing.T) {
+	c := &retryClient{
+		outputs: []*kinesis.PutRecordsOutput{
+			{
+				FailedRecordCount: aws.Int64(1),
+				Records: []*kinesis.PutRecordsResultEntry{
+					{ErrorCode: aws.String("InternalFailure")},
+				},
+			},
+			{FailedRecordCount: aws.Int64(0)},
+		},
+	}
+	f := newFlusher(c, flusherConfig{retryLimit: 1}).(*flusher)
+	f.dropInputFunc = func(kinesis.PutRecordsInput) {}
+	go f.start()
+	defer f.stop()
+
+	wait := func(cond func() bool) {
+		for start := time.Now(); !cond(); time.Sleep(time.Millisecond) {
+			if time.Since(start) > time.Second {
+				t.Fatal("Expected the input to be sent")
+			}
+		}
+	}
+
+	f.flush(*testInput("a"))
+	wait(func() bool { return f.lastError() != nil })
+	assert.True(t, f.lastFlush().IsZero(), "The records weren't accepted")
+
+	// The error is cleared once an input is accepted.
+	f.flush(*testInput("b"))
+	wait(func() bool { return f.lastError() == nil })
+	assert.False(t, f.lastFlush().IsZero())
+}
+
+func TestFlusher_StopSendsQueuedInputs(t *testing.T) {
+	c := &retryClient{
+		outputs: []*kinesis.PutRecordsOutput{{FailedRecordCount: aws.Int64(0)}},
+	}
+	f := newFlusher(c, flusherConfig{}).(*flusher)
+
+	f.flush(*testInput("a", "b"))
+	f.flush(*testInput("c"))
+	assert.Equal(t, 3, f.pending())
+
+	f.stop()
+	go f.start()
+
+	select {
+	case <-f.done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected the queued inputs to be sent")
+	}
+
+	assert.Equal(t, 0, f.pending())
+	assert.Len(t, c.inputs, 2)
+}
@@ -0,0 +1,140 @@
+package kinesis
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+const (
+	// RawFormat writes the log line as is in the record.
+	RawFormat = "raw"
+
+	// JSONFormat writes a JSON document describing the log line and its
+	// container in the record.
+	JSONFormat = "json"
+)
+
+// UnknownFormatError is returned when the record format isn't supported.
+type UnknownFormatError struct {
+	Format string
+}
+
+func (e *UnknownFormatError) Error() string {
+	return fmt.Sprintf("unknown record format: %s", e.Format)
+}
+
+// Formatter encodes a message into the data of a Kinesis record.
+type Formatter interface {
+	Format(m *router.Message) ([]byte, error)
+}
+
+// NewFormatter returns the formatter for the given format. The labels and
+// env are the container labels and environment variables the JSON format
+// includes in the record.
+func NewFormatter(format string, labels, env []string) (Formatter, error) {
+	switch format {
+	case "", RawFormat:
+		return &rawFormatter{}, nil
+	case JSONFormat:
+		return &jsonFormatter{labels: labels, env: env}, nil
+	default:
+		return nil, &UnknownFormatError{Format: format}
+	}
+}
+
+type rawFormatter struct{}
+
+func (f *rawFormatter) Format(m *router.Message) ([]byte, error) {
+	return []byte(m.Data), nil
+}
+
+type templateFormatter struct {
+	tmpl *template.Template
+}
+
+func (f *templateFormatter) Format(m *router.Message) ([]byte, error) {
+	data, err := executeTmpl(f.tmpl, m)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(data), nil
+}
+
+type jsonRecord struct {
+	Data          string            `json:"data"`
+	Time          time.Time         `json:"time"`
+	Source        string            `json:"source"`
+	ContainerID   string            `json:"container_id"`
+	ContainerName string            `json:"container_name"`
+	Image         string            `json:"image"`
+	Hostname      string            `json:"hostname"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Env           map[string]string `json:"env,omitempty"`
+}
+
+type jsonFormatter struct {
+	labels []string
+	env    []string
+}
+
+func (f *jsonFormatter) Format(m *router.Message) ([]byte, error) {
+	r := jsonRecord{
+		Data:   m.Data,
+		Time:   m.Time,
+		Source: m.Source,
+	}
+
+	if c := m.Container; c != nil {
+		r.ContainerID = c.ID
+		r.ContainerName = strings.TrimPrefix(c.Name, "/")
+
+		if c.Config != nil {
+			r.Image = c.Config.Image
+			r.Hostname = c.Config.Hostname
+			r.Labels = f.pickLabels(c.Config.Labels)
+			r.Env = f.pickEnv(c.Config.Env)
+		}
+	}
+
+	return json.Marshal(r)
+}
+
+func (f *jsonFormatter) pickLabels(labels map[string]string) map[string]string {
+	picked := make(map[string]string)
+	for _, k := range f.labels {
+		if v, ok := labels[k]; ok {
+			picked[k] = v
+		}
+	}
+
+	return picked
+}
+
+func (f *jsonFormatter) pickEnv(env []string) map[string]string {
+	picked := make(map[string]string)
+	for _, k := range f.env {
+		if v := lookUp(env, k); v != "" {
+			picked[k] = v
+		}
+	}
+
+	return picked
+}
+
+// splitList splits a comma separated list, ignoring the empty items.
+func splitList(s string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
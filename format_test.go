@@ -0,0 +1,84 @@
+package kinesis
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatter_Raw(t *testing.T) {
+	f, err := NewFormatter("", nil, nil)
+	assert.Nil(t, err)
+
+	data, err := f.Format(&router.Message{Data: "hello"})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), data)
+}
+
+func TestFormatter_JSON(t *testing.T) {
+	f, err := NewFormatter(JSONFormat, []string{"app", "missing"}, []string{"APP_ID"})
+	assert.Nil(t, err)
+
+	m := &router.Message{
+		Data:   "hello",
+		Source: "stderr",
+		Time:   time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC),
+		Container: &docker.Container{
+			ID:   "123",
+			Name: "/web.1",
+			Config: &docker.Config{
+				Hostname: "abcdef",
+				Image:    "remind101/acme-inc:latest",
+				Labels:   map[string]string{"app": "acme-inc", "other": "x"},
+				Env:      []string{"APP_ID=42", "SECRET=shh"},
+			},
+		},
+	}
+
+	data, err := f.Format(m)
+	assert.Nil(t, err)
+
+	var r jsonRecord
+	assert.Nil(t, json.Unmarshal(data, &r))
+	assert.Equal(t, jsonRecord{
+		Data:          "hello",
+		Time:          m.Time,
+		Source:        "stderr",
+		ContainerID:   "123",
+		ContainerName: "web.1",
+		Image:         "remind101/acme-inc:latest",
+		Hostname:      "abcdef",
+		Labels:        map[string]string{"app": "acme-inc"},
+		Env:           map[string]string{"APP_ID": "42"},
+	}, r)
+}
+
+func TestFormatter_Unknown(t *testing.T) {
+	_, err := NewFormatter("xml", nil, nil)
+	assert.Equal(t, &UnknownFormatError{Format: "xml"}, err)
+}
+
+func TestFormatter_Template(t *testing.T) {
+	tmpl, err := parseTmpl(`app={{ label .Container "app" }} time={{ timeFormat .Time "2006-01-02" }} msg={{ json .Data }}`)
+	assert.Nil(t, err)
+	f := &templateFormatter{tmpl: tmpl}
+
+	m := &router.Message{
+		Data: `say "hello"`,
+		Time: time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC),
+		Container: &docker.Container{
+			ID: "123",
+			Config: &docker.Config{
+				Labels: map[string]string{"app": "acme-inc"},
+			},
+		},
+	}
+
+	data, err := f.Format(m)
+	assert.Nil(t, err)
+	assert.Equal(t, `app=acme-inc time=2016-01-02 msg="say \"hello\""`, string(data))
+}
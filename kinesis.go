@@ -4,14 +4,19 @@ import (
 	"errors"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"text/template"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
 	"github.com/gliderlabs/logspout/router"
 )
 
 func init() {
 	router.AdapterFactories.Register(NewAdapter, "kinesis")
+	router.AdapterFactories.Register(NewFirehoseAdapter, "firehose")
 }
 
 var (
@@ -25,27 +30,152 @@ var (
 	ErrMissingTagValue = errors.New("the tag value is empty, check your template KINESIS_STREAM_TAG_VALUE")
 )
 
+const (
+	// DefaultShutdownTimeout is the default time given to the streams to send
+	// their records when the adapter stops.
+	DefaultShutdownTimeout = 10 * time.Second
+
+	// DefaultIdleTimeout is the default time after which the writer of a
+	// container that stopped logging is evicted.
+	DefaultIdleTimeout = 10 * time.Minute
+)
+
 // Adapter represents the logspout adapter for Kinesis.
 type Adapter struct {
+	// RouteID is the ID of the route of the adapter, labelling its metrics.
+	RouteID string
+
 	Streams    map[string]*Stream
 	StreamTmpl *template.Template
-	TagTmpl    *template.Template
-	PKeyTmpl   *template.Template
+	TagTmpls   map[string]*template.Template
+	// TagKey is the key of the KINESIS_STREAM_TAG_KEY tag, whose value is
+	// required.
+	TagKey           string
+	ShardsTmpl       *template.Template
+	KMSKeyTmpl       *template.Template
+	RoleTmpl         *template.Template
+	ExternalIDTmpl   *template.Template
+	BackpressureTmpl *template.Template
+	Config           *Config
+	ShutdownTimeout  time.Duration
+	IdleTimeout      time.Duration
+
+	// FallbackStream receives the messages whose templates can't be
+	// rendered. Empty skips them.
+	FallbackStream string
+
+	// mutex guards Streams against the metrics and status handlers.
+	mutex sync.RWMutex
+	roles *roleClients
+	// overrides caches the overrides of the containers labels.
+	overrides map[string]*overrides
+	// templateErrors counts the messages whose templates couldn't be
+	// rendered.
+	templateErrors int64
+	errorLimiter   errorLimiter
 }
 
 // NewAdapter creates a kinesis adapter. Called during init.
 func NewAdapter(route *router.Route) (router.LogAdapter, error) {
-	sTmpl, err := compileTmpl("KINESIS_STREAM_TEMPLATE")
+	return newAdapter(route, nil)
+}
+
+// newAdapter creates an adapter sending the records to Kinesis streams, or
+// to Firehose delivery streams if firehose is set.
+func newAdapter(route *router.Route, firehose *FirehoseConfig) (*Adapter, error) {
+	debugOn := routeOpt(route, "KINESIS_DEBUG") == "true"
+
+	sTmpl, err := compileTmpl(route, "KINESIS_STREAM_TEMPLATE")
 	if err != nil {
 		return nil, err
 	}
 
-	tagTmpl, err := compileTmpl("KINESIS_STREAM_TAG_VALUE")
+	skipTag := routeOpt(route, "KINESIS_STREAM_TAG") == "false"
+
+	// The tags are only required when tagging the streams.
+	var tagTmpls map[string]*template.Template
+	if !skipTag {
+		tagTmpls, err = compileTagTmpls(route)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Firehose records don't have a partition key.
+	var pKeyTmpl *template.Template
+	if firehose == nil {
+		pKeyTmpl, err = compileTmpl(route, "KINESIS_PARTITION_KEY_TEMPLATE")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The shard count is optional, the streams are created with one shard.
+	var shardsTmpl *template.Template
+	if routeOpt(route, "KINESIS_STREAM_SHARDS") != "" {
+		shardsTmpl, err = compileTmpl(route, "KINESIS_STREAM_SHARDS")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The KMS key is optional, and Firehose delivery streams aren't
+	// encrypted by the adapter.
+	var kmsKeyTmpl *template.Template
+	if firehose == nil && routeOpt(route, "KINESIS_STREAM_KMS_KEY_ID") != "" {
+		kmsKeyTmpl, err = compileTmpl(route, "KINESIS_STREAM_KMS_KEY_ID")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The streams are managed with the credentials of the route, unless
+	// they assume a role.
+	var roleTmpl, externalIDTmpl *template.Template
+	if routeOpt(route, "KINESIS_ROLE_ARN") != "" {
+		roleTmpl, err = compileTmpl(route, "KINESIS_ROLE_ARN")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if routeOpt(route, "KINESIS_ROLE_EXTERNAL_ID") != "" {
+		externalIDTmpl, err = compileTmpl(route, "KINESIS_ROLE_EXTERNAL_ID")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The backpressure policy is optional, the default depends on the
+	// spool.
+	var backpressureTmpl *template.Template
+	if routeOpt(route, "KINESIS_BACKPRESSURE") != "" {
+		backpressureTmpl, err = compileTmpl(route, "KINESIS_BACKPRESSURE")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	formatter, err := newAdapterFormatter(route)
 	if err != nil {
 		return nil, err
 	}
 
-	pKeyTmpl, err := compileTmpl("KINESIS_PARTITION_KEY_TEMPLATE")
+	codec, err := NewCodec(routeOpt(route, "KINESIS_COMPRESSION"))
+	if err != nil {
+		return nil, err
+	}
+
+	tmplOptions, err := tmplOptions(route)
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := routeSession(route)
+	if err != nil {
+		return nil, err
+	}
+
+	cloudWatch, err := cloudWatchConfig(route, sess)
 	if err != nil {
 		return nil, err
 	}
@@ -53,61 +183,342 @@ func NewAdapter(route *router.Route) (router.LogAdapter, error) {
 	streams := make(map[string]*Stream)
 
 	return &Adapter{
-		Streams:    streams,
-		StreamTmpl: sTmpl,
-		TagTmpl:    tagTmpl,
-		PKeyTmpl:   pKeyTmpl,
+		RouteID:          routeID(route),
+		Streams:          streams,
+		StreamTmpl:       sTmpl,
+		TagTmpls:         tagTmpls,
+		TagKey:           routeOpt(route, "KINESIS_STREAM_TAG_KEY"),
+		ShardsTmpl:       shardsTmpl,
+		KMSKeyTmpl:       kmsKeyTmpl,
+		RoleTmpl:         roleTmpl,
+		ExternalIDTmpl:   externalIDTmpl,
+		BackpressureTmpl: backpressureTmpl,
+		ShutdownTimeout:  getDurationOpt(route, "KINESIS_SHUTDOWN_TIMEOUT", DefaultShutdownTimeout),
+		IdleTimeout:      getDurationOpt(route, "KINESIS_WRITER_IDLE_TIMEOUT", DefaultIdleTimeout),
+		FallbackStream:   routeOpt(route, "KINESIS_FALLBACK_STREAM"),
+		overrides:        make(map[string]*overrides),
+		errorLimiter:     errorLimiter{interval: getDurationOpt(route, "KINESIS_ERROR_LOG_INTERVAL", DefaultErrorLogInterval)},
+		roles:            newRoleClients(sess, routeOpt(route, "KINESIS_STS_ENDPOINT"), firehose, debugLogger(debugOn)),
+		Config: &Config{
+			Client:            NewClient(sess, firehose),
+			PKeyTmpl:          pKeyTmpl,
+			Formatter:         formatter,
+			RecordLabels:      splitList(routeOpt(route, "KINESIS_RECORD_LABELS")),
+			RecordEnv:         splitList(routeOpt(route, "KINESIS_RECORD_ENV")),
+			TmplOptions:       tmplOptions,
+			Aggregate:         firehose == nil && routeOpt(route, "KINESIS_AGGREGATE") == "true",
+			Codec:             codec,
+			CodecMarker:       routeOpt(route, "KINESIS_COMPRESSION_MARKER") == "true",
+			Firehose:          firehose,
+			PendingLimit:      getIntOpt(route, "KINESIS_PENDING_LIMIT", DefaultPendingLimit),
+			PendingSizeLimit:  getIntOpt(route, "KINESIS_PENDING_SIZE_LIMIT", DefaultPendingSizeLimit),
+			RetryLimit:        getIntOpt(route, "KINESIS_RETRY_LIMIT", DefaultRetryLimit),
+			ReadyTimeout:      getDurationOpt(route, "KINESIS_STREAM_READY_TIMEOUT", DefaultReadyTimeout),
+			RetryInterval:     getDurationOpt(route, "KINESIS_STREAM_RETRY_INTERVAL", DefaultRetryInterval),
+			SkipCreate:        routeOpt(route, "KINESIS_STREAM_CREATE") == "false",
+			SkipTag:           skipTag,
+			SkipRetag:         routeOpt(route, "KINESIS_STREAM_RETAG") == "false",
+			OnDemand:          routeOpt(route, "KINESIS_STREAM_MODE") == "on-demand",
+			Reshard:           reshardConfig(route),
+			CloudWatch:        cloudWatch,
+			Spool:             spoolConfig(route),
+			QueueDepth:        getIntOpt(route, "KINESIS_QUEUE_DEPTH", DefaultQueueDepth),
+			BlockTimeout:      getDurationOpt(route, "KINESIS_BACKPRESSURE_TIMEOUT", DefaultBlockTimeout),
+			RequireEncryption: firehose == nil && routeOpt(route, "KINESIS_STREAM_ENCRYPTION_REQUIRED") == "true",
+			Debug:             debugOn,
+		},
 	}, nil
 }
 
 // Stream handles the routing of a message to Kinesis.
 func (a *Adapter) Stream(logstream chan *router.Message) {
-	for m := range logstream {
-		sn, err := executeTmpl(a.StreamTmpl, m)
+	adapters.register(a)
+	defer adapters.unregister(a)
+
+	exits := containerExits.subscribe()
+	defer containerExits.unsubscribe(exits)
+
+	// The publisher publishes a last time once the streams are flushed.
+	if a.Config.CloudWatch != nil {
+		quit, done := make(chan struct{}), make(chan struct{})
+		go func() {
+			newCloudWatchPublisher(a.Config.CloudWatch, a.streams).run(quit)
+			close(done)
+		}()
+		defer func() {
+			close(quit)
+			<-done
+		}()
+	}
+
+	var sweep <-chan time.Time
+	if a.IdleTimeout > 0 {
+		t := time.NewTicker(a.IdleTimeout / 2)
+		defer t.Stop()
+		sweep = t.C
+	}
+
+	for {
+		select {
+		case m, ok := <-logstream:
+			if !ok {
+				a.shutdown()
+				return
+			}
+
+			a.route(m)
+		case id := <-exits:
+			delete(a.overrides, id)
+			for _, s := range a.Streams {
+				s.evict(id)
+			}
+		case <-sweep:
+			for id, o := range a.overrides {
+				if time.Since(o.seen) > a.IdleTimeout {
+					delete(a.overrides, id)
+				}
+			}
+			for _, s := range a.Streams {
+				s.evictIdle(a.IdleTimeout)
+			}
+		}
+	}
+}
+
+// route writes the message to its stream. A message whose templates can't be
+// rendered is skipped, or written to the fallback stream if set.
+func (a *Adapter) route(m *router.Message) {
+	o := a.containerOverrides(m)
+	if !o.keep() {
+		return
+	}
+
+	s, err := a.stream(m, o)
+	if err != nil {
+		a.templateError(m, err)
+		if a.FallbackStream == "" {
+			return
+		}
+
+		s = a.fallbackStream()
+	}
+
+	if s == nil {
+		debugLogger(a.Config.Debug).printf("the stream name is empty, couldn't match the template. Skipping the log.")
+		return
+	}
+
+	// The message is queued until the stream is ready.
+	ErrorHandler(s.writeOverridden(m, o))
+}
+
+// stream returns the stream of the message, creating it on its first
+// message, or nil if the stream name is empty.
+func (a *Adapter) stream(m *router.Message, o *overrides) (*Stream, error) {
+	sn := o.stream
+	if sn == "" {
+		var err error
+		sn, err = executeTmpl(a.StreamTmpl, m)
 		if err != nil {
-			ErrorHandler(err)
-			break
+			return nil, err
 		}
+	}
+
+	if sn == "" {
+		return nil, nil
+	}
+
+	role, err := executeOptTmpl(a.RoleTmpl, m)
+	if err != nil {
+		return nil, err
+	}
 
-		if sn == "" {
-			debug("the stream name is empty, couldn't match the template. Skipping the log.")
-			continue
+	// The same stream name may be in the accounts of different roles.
+	key := sn
+	if role != "" {
+		key = role + "/" + sn
+	}
+
+	if s, ok := a.Streams[key]; ok {
+		return s, nil
+	}
+
+	var tags *map[string]*string
+	if !a.Config.SkipTag {
+		tags, err = streamTags(a.TagTmpls, a.TagKey, m, debugLogger(a.Config.Debug))
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		if s, ok := a.Streams[sn]; ok {
-			ErrorHandler(s.Write(m))
-		} else {
-			tags, err := tags(a.TagTmpl, m)
-			if err != nil {
-				ErrorHandler(err)
-				break
-			}
+	kmsKeyID, err := executeOptTmpl(a.KMSKeyTmpl, m)
+	if err != nil {
+		return nil, err
+	}
 
-			s := NewStream(sn, tags, a.PKeyTmpl)
-			s.Start()
-			a.Streams[sn] = s
+	var client Client
+	if role != "" {
+		externalID, err := executeOptTmpl(a.ExternalIDTmpl, m)
+		if err != nil {
+			return nil, err
 		}
+		client = a.roles.get(role, externalID)
+	}
+
+	return a.startStream(key, StreamSpec{
+		Name:         sn,
+		Tags:         tags,
+		Shards:       streamShards(a.ShardsTmpl, sn, m),
+		KMSKeyID:     kmsKeyID,
+		Client:       client,
+		Backpressure: streamBackpressure(a.BackpressureTmpl, a.Config, sn, m),
+	}), nil
+}
+
+// fallbackStream returns the fallback stream, creating it on its first
+// message. It's neither tagged nor encrypted.
+func (a *Adapter) fallbackStream() *Stream {
+	if s, ok := a.Streams[a.FallbackStream]; ok {
+		return s
+	}
+
+	return a.startStream(a.FallbackStream, StreamSpec{Name: a.FallbackStream})
+}
+
+func (a *Adapter) startStream(key string, spec StreamSpec) *Stream {
+	spec.Key = key
+	s := NewStream(spec, a.Config)
+	s.templateError = a.bufferTemplateError
+	s.Start()
+
+	a.mutex.Lock()
+	a.Streams[key] = s
+	a.mutex.Unlock()
+
+	return s
+}
+
+// streams returns a copy of the streams, safe to use from another goroutine.
+func (a *Adapter) streams() map[string]*Stream {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	streams := make(map[string]*Stream, len(a.Streams))
+	for key, s := range a.Streams {
+		streams[key] = s
+	}
+
+	return streams
+}
+
+// templateError counts the template errors, and reports them at most once
+// per error log interval.
+func (a *Adapter) templateError(m *router.Message, err error) {
+	a.reportTemplateError(m, err, a.FallbackStream)
+}
+
+// bufferTemplateError counts and reports the errors of the partition key and
+// record templates, rendered by the writers. The message is already in its
+// stream, so it's skipped rather than sent to the fallback stream.
+func (a *Adapter) bufferTemplateError(m *router.Message, err error) {
+	a.reportTemplateError(m, err, "")
+}
+
+func (a *Adapter) reportTemplateError(m *router.Message, err error, fallback string) {
+	atomic.AddInt64(&a.templateErrors, 1)
+
+	if suppressed, ok := a.errorLimiter.allow(); ok {
+		ErrorHandler(&TemplateError{
+			Container:  m.Container.ID,
+			Fallback:   fallback,
+			Suppressed: suppressed,
+			Err:        err,
+		})
+	}
+}
+
+// containerOverrides returns the overrides of the container of the message,
+// resolving them on its first message.
+func (a *Adapter) containerOverrides(m *router.Message) *overrides {
+	if o, ok := a.overrides[m.Container.ID]; ok {
+		o.seen = time.Now()
+		return o
 	}
+
+	o, err := newOverrides(m.Container, a.Config)
+	ErrorHandler(err)
+	if a.overrides != nil {
+		a.overrides[m.Container.ID] = o
+	}
+
+	return o
 }
 
-func tags(tmpl *template.Template, m *router.Message) (*map[string]*string, error) {
-	tagKey := os.Getenv("KINESIS_STREAM_TAG_KEY")
-	if tagKey == "" {
-		return nil, ErrMissingTagKey
+// streamShards renders the shard count of the stream, zero meaning the
+// default. An invalid count is reported and the stream is created with the
+// default rather than losing its messages.
+func streamShards(tmpl *template.Template, sn string, m *router.Message) int64 {
+	if tmpl == nil {
+		return 0
 	}
 
-	tagValue, err := executeTmpl(tmpl, m)
+	value, err := executeTmpl(tmpl, m)
 	if err != nil {
-		return nil, err
+		ErrorHandler(err)
+		return 0
 	}
 
-	if tagValue == "" {
-		return nil, ErrMissingTagValue
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
 	}
 
-	return &map[string]*string{
-		tagKey: aws.String(tagValue),
-	}, nil
+	shards, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || shards <= 0 {
+		ErrorHandler(&InvalidShardCountError{Stream: sn, Value: value})
+		return 0
+	}
+
+	return shards
+}
+
+// shutdown flushes the streams, and waits for their records to be sent
+// until the shutdown timeout.
+func (a *Adapter) shutdown() {
+	log.Println("kinesis: shutting down, flushing the streams")
+
+	for _, s := range a.Streams {
+		s.stop()
+	}
+
+	timeout := make(chan struct{})
+	timer := time.AfterFunc(a.ShutdownTimeout, func() { close(timeout) })
+	defer timer.Stop()
+
+	for _, s := range a.Streams {
+		if lost := s.wait(timeout); lost > 0 {
+			ErrorHandler(&LostRecordsError{Stream: s.name, Count: lost})
+		}
+	}
+}
+
+// newAdapterFormatter returns a formatter rendering KINESIS_RECORD_TEMPLATE if
+// it's set, or the formatter for KINESIS_RECORD_FORMAT.
+func newAdapterFormatter(route *router.Route) (Formatter, error) {
+	if routeOpt(route, "KINESIS_RECORD_TEMPLATE") != "" {
+		tmpl, err := compileTmpl(route, "KINESIS_RECORD_TEMPLATE")
+		if err != nil {
+			return nil, err
+		}
+
+		return &templateFormatter{tmpl: tmpl}, nil
+	}
+
+	return NewFormatter(
+		routeOpt(route, "KINESIS_RECORD_FORMAT"),
+		splitList(routeOpt(route, "KINESIS_RECORD_LABELS")),
+		splitList(routeOpt(route, "KINESIS_RECORD_ENV")),
+	)
 }
 
 func logErr(err error) {
@@ -116,8 +527,20 @@ func logErr(err error) {
 	}
 }
 
+// debug prints the debug logs that aren't specific to a route, if
+// KINESIS_DEBUG is set.
 func debug(format string, p ...interface{}) {
 	if os.Getenv("KINESIS_DEBUG") == "true" {
 		log.Printf("kinesis: "+format, p...)
 	}
 }
+
+// debugLogger prints the debug logs of an adapter when enabled, from its
+// route or KINESIS_DEBUG.
+type debugLogger bool
+
+func (d debugLogger) printf(format string, p ...interface{}) {
+	if d {
+		log.Printf("kinesis: "+format, p...)
+	}
+}
@@ -0,0 +1,90 @@
+package kinesis
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdapter_RouteTemplateError(t *testing.T) {
+	tmpl, _ := parseTmpl(`{{ .Container.Config.Labels.app }}`, "missingkey=error")
+	a := &Adapter{
+		Streams:    make(map[string]*Stream),
+		StreamTmpl: tmpl,
+		Config:     &Config{Client: &fakeClient{status: "ACTIVE"}, SkipTag: true},
+		overrides:  make(map[string]*overrides),
+	}
+
+	var reported []error
+	ErrorHandler = func(err error) {
+		if err != nil {
+			reported = append(reported, err)
+		}
+	}
+	defer func() { ErrorHandler = logErr }()
+
+	m := &router.Message{Container: labeledContainer(map[string]string{})}
+	a.route(m)
+	assert.Len(t, a.Streams, 0)
+	assert.Equal(t, int64(1), a.templateErrors)
+	assert.Len(t, reported, 1)
+	assert.IsType(t, &TemplateError{}, reported[0])
+
+	a.FallbackStream = "fallback"
+	a.route(m)
+	assert.Equal(t, int64(2), a.templateErrors)
+	_, ok := a.Streams["fallback"]
+	assert.True(t, ok)
+
+	// The stream of a container with the label is still created.
+	a.route(&router.Message{Container: labeledContainer(map[string]string{"app": "abc"})})
+	_, ok = a.Streams["abc"]
+	assert.True(t, ok)
+
+	for _, s := range a.Streams {
+		s.stop()
+	}
+}
+
+func TestAdapter_BufferTemplateError(t *testing.T) {
+	pKeyTmpl, _ := parseTmpl(`{{ label .Container "app" }}`, "missingkey=error")
+	sTmpl, _ := parseTmpl("abc")
+	a := &Adapter{
+		Streams:        make(map[string]*Stream),
+		StreamTmpl:     sTmpl,
+		Config:         &Config{Client: &fakeClient{status: "ACTIVE"}, SkipTag: true, SkipCreate: true, PKeyTmpl: pKeyTmpl},
+		FallbackStream: "fallback",
+		overrides:      make(map[string]*overrides),
+	}
+
+	reported := make(chan error, 1)
+	ErrorHandler = func(err error) {
+		if err == nil {
+			return
+		}
+		select {
+		case reported <- err:
+		default:
+		}
+	}
+	defer func() { ErrorHandler = logErr }()
+
+	// The partition key template fails in the writer, once the stream is
+	// ready.
+	a.route(&router.Message{Container: labeledContainer(map[string]string{}), Data: "hello"})
+
+	select {
+	case err := <-reported:
+		assert.Equal(t, "", err.(*TemplateError).Fallback)
+		assert.Equal(t, int64(1), atomic.LoadInt64(&a.templateErrors))
+	case <-time.After(time.Second):
+		t.Fatal("Expected the template error to be reported")
+	}
+
+	for _, s := range a.streams() {
+		s.stop()
+	}
+}
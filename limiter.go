@@ -0,0 +1,37 @@
+package kinesis
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultErrorLogInterval is the default minimum time between two reports of
+// the errors of the messages, e.g. the template errors.
+const DefaultErrorLogInterval = time.Minute
+
+// errorLimiter allows reporting an error at most once per interval, and
+// counts the errors suppressed in between.
+type errorLimiter struct {
+	mutex      sync.Mutex
+	interval   time.Duration
+	last       time.Time
+	suppressed int
+}
+
+// allow tells if an error can be reported, and returns the number of errors
+// suppressed since the last one reported.
+func (l *errorLimiter) allow() (int, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if !l.last.IsZero() && now.Sub(l.last) < l.interval {
+		l.suppressed++
+		return 0, false
+	}
+
+	suppressed := l.suppressed
+	l.last = now
+	l.suppressed = 0
+	return suppressed, true
+}
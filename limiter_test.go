@@ -0,0 +1,25 @@
+package kinesis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorLimiter(t *testing.T) {
+	l := &errorLimiter{interval: time.Hour}
+
+	_, ok := l.allow()
+	assert.True(t, ok)
+
+	for i := 0; i < 3; i++ {
+		_, ok = l.allow()
+		assert.False(t, ok)
+	}
+
+	l.last = time.Now().Add(-2 * time.Hour)
+	suppressed, ok := l.allow()
+	assert.True(t, ok)
+	assert.Equal(t, 3, suppressed)
+}
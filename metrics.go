@@ -0,0 +1,289 @@
+package kinesis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+func init() {
+	router.HttpHandlers.Register(metricsHandler, "metrics")
+}
+
+// latencyBuckets are the upper bounds, in seconds, of the PutRecords latency
+// histogram buckets.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// streamMetrics counts what happens to the records of a stream. A nil
+// streamMetrics counts nothing. The metrics of the containers of a stream
+// sharing the same CloudWatch dimensions count in their parent, the metrics
+// of the stream, too.
+type streamMetrics struct {
+	parent *streamMetrics
+
+	recordsBuffered int64
+	bytesBuffered   int64
+	recordsFlushed  int64
+	bytesFlushed    int64
+	recordsFailed   int64
+	recordsRetried  int64
+	recordsDropped  int64
+	recordsTooBig   int64
+	recordsSpooled  int64
+	pendingDropped  int64
+
+	latencyMutex  sync.Mutex
+	latencyCounts []uint64
+	latencySum    float64
+	latencyCount  uint64
+}
+
+func newStreamMetrics() *streamMetrics {
+	return &streamMetrics{
+		latencyCounts: make([]uint64, len(latencyBuckets)),
+	}
+}
+
+func (m *streamMetrics) buffered(records, bytes int) {
+	if m == nil {
+		return
+	}
+
+	atomic.AddInt64(&m.recordsBuffered, int64(records))
+	atomic.AddInt64(&m.bytesBuffered, int64(bytes))
+	m.parent.buffered(records, bytes)
+}
+
+func (m *streamMetrics) flushed(records, bytes int) {
+	if m == nil {
+		return
+	}
+
+	atomic.AddInt64(&m.recordsFlushed, int64(records))
+	atomic.AddInt64(&m.bytesFlushed, int64(bytes))
+	m.parent.flushed(records, bytes)
+}
+
+func (m *streamMetrics) failed(records int) {
+	if m != nil {
+		atomic.AddInt64(&m.recordsFailed, int64(records))
+		m.parent.failed(records)
+	}
+}
+
+func (m *streamMetrics) retried(records int) {
+	if m != nil {
+		atomic.AddInt64(&m.recordsRetried, int64(records))
+		m.parent.retried(records)
+	}
+}
+
+func (m *streamMetrics) dropped(records int) {
+	if m != nil {
+		atomic.AddInt64(&m.recordsDropped, int64(records))
+		m.parent.dropped(records)
+	}
+}
+
+func (m *streamMetrics) spooled(records int) {
+	if m != nil {
+		atomic.AddInt64(&m.recordsSpooled, int64(records))
+		m.parent.spooled(records)
+	}
+}
+
+// droppedPending counts a message dropped because the pending queue of the
+// stream was full.
+func (m *streamMetrics) droppedPending() {
+	if m != nil {
+		atomic.AddInt64(&m.pendingDropped, 1)
+		m.parent.droppedPending()
+	}
+}
+
+func (m *streamMetrics) tooBig() {
+	if m != nil {
+		atomic.AddInt64(&m.recordsTooBig, 1)
+		m.parent.tooBig()
+	}
+}
+
+// observeLatency records the duration of a PutRecords request.
+func (m *streamMetrics) observeLatency(d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.latencyMutex.Lock()
+	seconds := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			m.latencyCounts[i]++
+		}
+	}
+	m.latencySum += seconds
+	m.latencyCount++
+	m.latencyMutex.Unlock()
+
+	m.parent.observeLatency(d)
+}
+
+// adapterRegistry holds the running adapters, whose metrics are served.
+type adapterRegistry struct {
+	mutex    sync.Mutex
+	adapters []*Adapter
+}
+
+var adapters = &adapterRegistry{}
+
+func (r *adapterRegistry) register(a *Adapter) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.adapters = append(r.adapters, a)
+}
+
+func (r *adapterRegistry) unregister(a *Adapter) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for i, other := range r.adapters {
+		if other == a {
+			r.adapters = append(r.adapters[:i], r.adapters[i+1:]...)
+			return
+		}
+	}
+}
+
+func (r *adapterRegistry) list() []*Adapter {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]*Adapter(nil), r.adapters...)
+}
+
+// metricsHandler serves the metrics of the adapters in the Prometheus text
+// format.
+func metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, adapters.list())
+	})
+}
+
+// streamSample is the state of a stream when the metrics are scraped.
+type streamSample struct {
+	labels string
+	state  streamState
+}
+
+func writeMetrics(out io.Writer, list []*Adapter) {
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	var samples []streamSample
+	for _, a := range list {
+		streams := a.streams()
+
+		keys := make([]string, 0, len(streams))
+		for key := range streams {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			samples = append(samples, streamSample{
+				labels: fmt.Sprintf(`route=%s,stream=%s`, quoteLabel(a.RouteID), quoteLabel(key)),
+				state:  streams[key].state(),
+			})
+		}
+	}
+
+	family := func(name, kind, help string, value func(s streamSample) string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, s := range samples {
+			fmt.Fprintf(w, "%s{%s} %s\n", name, s.labels, value(s))
+		}
+	}
+	counter := func(name, help string, value func(m *streamMetrics) *int64) {
+		family(name, "counter", help, func(s streamSample) string {
+			return strconv.FormatInt(atomic.LoadInt64(value(s.state.metrics)), 10)
+		})
+	}
+	gauge := func(name, help string, value func(s streamState) int) {
+		family(name, "gauge", help, func(s streamSample) string {
+			return strconv.Itoa(value(s.state))
+		})
+	}
+
+	counter("kinesis_records_buffered_total", "Records added to the buffers.",
+		func(m *streamMetrics) *int64 { return &m.recordsBuffered })
+	counter("kinesis_bytes_buffered_total", "Bytes of the records added to the buffers.",
+		func(m *streamMetrics) *int64 { return &m.bytesBuffered })
+	counter("kinesis_records_flushed_total", "Records accepted by Kinesis.",
+		func(m *streamMetrics) *int64 { return &m.recordsFlushed })
+	counter("kinesis_bytes_flushed_total", "Bytes of the records accepted by Kinesis.",
+		func(m *streamMetrics) *int64 { return &m.bytesFlushed })
+	counter("kinesis_records_failed_total", "Records given up on after the retries.",
+		func(m *streamMetrics) *int64 { return &m.recordsFailed })
+	counter("kinesis_records_retried_total", "Records rejected by Kinesis and sent again.",
+		func(m *streamMetrics) *int64 { return &m.recordsRetried })
+	counter("kinesis_records_dropped_total", "Records dropped because the flusher queue was full.",
+		func(m *streamMetrics) *int64 { return &m.recordsDropped })
+	counter("kinesis_records_too_big_total", "Records dropped because they were over the size limit.",
+		func(m *streamMetrics) *int64 { return &m.recordsTooBig })
+	counter("kinesis_records_spooled_total", "Records written to the spool, to be replayed.",
+		func(m *streamMetrics) *int64 { return &m.recordsSpooled })
+	counter("kinesis_messages_pending_dropped_total", "Messages dropped because the pending queue of a stream that wasn't ready was full.",
+		func(m *streamMetrics) *int64 { return &m.pendingDropped })
+
+	gauge("kinesis_flusher_queue_depth", "Requests queued in the flushers.",
+		func(s streamState) int { return s.queued })
+	gauge("kinesis_writers", "Active writers, one per container.",
+		func(s streamState) int { return s.writers })
+	gauge("kinesis_stream_ready", "1 if the stream is ready, 0 while being created or failing.",
+		func(s streamState) int {
+			if s.ready {
+				return 1
+			}
+			return 0
+		})
+
+	name := "kinesis_put_records_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Latency of the PutRecords requests.\n# TYPE %s histogram\n", name, name)
+	for _, s := range samples {
+		m := s.state.metrics
+		m.latencyMutex.Lock()
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, s.labels,
+				strconv.FormatFloat(bound, 'g', -1, 64), m.latencyCounts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, s.labels, m.latencyCount)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", name, s.labels, strconv.FormatFloat(m.latencySum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, s.labels, m.latencyCount)
+		m.latencyMutex.Unlock()
+	}
+
+	name = "kinesis_template_errors_total"
+	fmt.Fprintf(w, "# HELP %s Messages whose templates couldn't be rendered.\n# TYPE %s counter\n", name, name)
+	for _, a := range list {
+		fmt.Fprintf(w, "%s{route=%s} %d\n", name, quoteLabel(a.RouteID), atomic.LoadInt64(&a.templateErrors))
+	}
+}
+
+// quoteLabel quotes a label value, escaping the backslashes, double quotes
+// and line feeds.
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
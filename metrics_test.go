@@ -0,0 +1,106 @@
+package kinesis
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamMetrics_Flusher(t *testing.T) {
+	c := &retryClient{
+		outputs: []*kinesis.PutRecordsOutput{
+			{
+				FailedRecordCount: aws.Int64(1),
+				Records: []*kinesis.PutRecordsResultEntry{
+					{SequenceNumber: aws.String("1")},
+					{ErrorCode: aws.String("ProvisionedThroughputExceededException")},
+				},
+			},
+			{
+				FailedRecordCount: aws.Int64(1),
+				Records: []*kinesis.PutRecordsResultEntry{
+					{ErrorCode: aws.String("ProvisionedThroughputExceededException")},
+				},
+			},
+		},
+	}
+	metrics := newStreamMetrics()
+	f := &flusher{
+		client:      c,
+		retryLimit:  2,
+		backoffFunc: noBackoff,
+		metrics:     metrics,
+	}
+
+	var err error
+	ErrorHandler = func(e error) {
+		if e != nil {
+			err = e
+		}
+	}
+	defer func() { ErrorHandler = logErr }()
+
+	f.flushInput(testInput("a", "b"))
+	assert.IsType(t, &FailedRecordsError{}, err)
+
+	assert.Equal(t, int64(1), metrics.recordsFlushed)
+	assert.Equal(t, int64(4), metrics.bytesFlushed)
+	assert.Equal(t, int64(1), metrics.recordsRetried)
+	assert.Equal(t, int64(1), metrics.recordsFailed)
+	assert.Equal(t, uint64(2), metrics.latencyCount)
+}
+
+func TestStreamMetrics_Dropped(t *testing.T) {
+	metrics := newStreamMetrics()
+	f := &flusher{
+		inputs:        make(chan kinesis.PutRecordsInput),
+		dropInputFunc: func(kinesis.PutRecordsInput) {},
+		metrics:       metrics,
+	}
+
+	f.flush(*testInput("a", "b"))
+	assert.Equal(t, int64(2), metrics.recordsDropped)
+}
+
+func TestStreamMetrics_Latency(t *testing.T) {
+	metrics := newStreamMetrics()
+	metrics.observeLatency(30 * time.Millisecond)
+
+	assert.Equal(t, uint64(0), metrics.latencyCounts[2], "0.025s bucket")
+	assert.Equal(t, uint64(1), metrics.latencyCounts[3], "0.05s bucket")
+	assert.Equal(t, uint64(1), metrics.latencyCounts[len(latencyBuckets)-1])
+}
+
+func TestMetricsHandler(t *testing.T) {
+	s := NewStream(StreamSpec{Name: "abc"}, &Config{Client: &fakeClient{}})
+	s.ready = true
+	s.metrics.buffered(3, 30)
+
+	a := &Adapter{
+		RouteID:        "route1",
+		Streams:        map[string]*Stream{"abc": s},
+		templateErrors: 2,
+	}
+	adapters.register(a)
+	defer adapters.unregister(a)
+
+	rec := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := rec.Body.String()
+	assert.Contains(t, body, "# TYPE kinesis_records_buffered_total counter\n")
+	assert.Contains(t, body, `kinesis_records_buffered_total{route="route1",stream="abc"} 3`)
+	assert.Contains(t, body, `kinesis_bytes_buffered_total{route="route1",stream="abc"} 30`)
+	assert.Contains(t, body, `kinesis_stream_ready{route="route1",stream="abc"} 1`)
+	assert.Contains(t, body, `kinesis_writers{route="route1",stream="abc"} 0`)
+	assert.Contains(t, body, `kinesis_put_records_duration_seconds_bucket{route="route1",stream="abc",le="+Inf"} 0`)
+	assert.Contains(t, body, `kinesis_template_errors_total{route="route1"} 2`)
+}
+
+func TestQuoteLabel(t *testing.T) {
+	assert.Equal(t, `"a\"b\\c\nd"`, quoteLabel("a\"b\\c\nd"))
+}
@@ -0,0 +1,144 @@
+package kinesis
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/gliderlabs/logspout/router"
+)
+
+// optionName returns the route option of the environment variable, e.g.
+// stream_template for KINESIS_STREAM_TEMPLATE.
+func optionName(envVar string) string {
+	return strings.ToLower(strings.TrimPrefix(envVar, "KINESIS_"))
+}
+
+// routeOpt returns the route option if it's set, or falls back to the
+// environment variable.
+func routeOpt(route *router.Route, envVar string) string {
+	if route != nil {
+		if value, ok := route.Options[optionName(envVar)]; ok {
+			return value
+		}
+	}
+
+	return os.Getenv(envVar)
+}
+
+// getIntOpt reads an integer from the route option or the environment
+// variable, and returns dfault if it's missing or invalid.
+func getIntOpt(route *router.Route, name string, dfault int) int {
+	value := routeOpt(route, name)
+	if value == "" {
+		return dfault
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		ErrorHandler(fmt.Errorf("invalid %s: %s, defaulting to %d", name, value, dfault))
+		return dfault
+	}
+
+	return i
+}
+
+// getDurationOpt reads a duration, e.g. "10s", from the route option or the
+// environment variable, and returns dfault if it's missing or invalid.
+func getDurationOpt(route *router.Route, name string, dfault time.Duration) time.Duration {
+	value := routeOpt(route, name)
+	if value == "" {
+		return dfault
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		ErrorHandler(fmt.Errorf("invalid %s: %s, defaulting to %s", name, value, dfault))
+		return dfault
+	}
+
+	return d
+}
+
+// routeSession creates the AWS session of the route, with the region,
+// credentials profile and endpoint of its address or options, and the TLS
+// verification and retries of its options.
+func routeSession(route *router.Route) (*session.Session, error) {
+	addr := parseRouteAddress(route)
+
+	config := aws.Config{
+		MaxRetries: aws.Int(getIntOpt(route, "KINESIS_MAX_RETRIES", aws.UseServiceDefaultRetries)),
+	}
+	if addr.region != "" {
+		config.Region = aws.String(addr.region)
+	}
+	if addr.endpoint != "" {
+		config.Endpoint = aws.String(addr.endpoint)
+	}
+	if routeOpt(route, "KINESIS_TLS_VERIFY") == "false" {
+		// e.g. a local stand-in with a self-signed certificate.
+		config.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		}
+	}
+
+	return session.NewSessionWithOptions(session.Options{
+		Config:            config,
+		Profile:           addr.profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+}
+
+// routeAddress is the AWS settings of a route address.
+type routeAddress struct {
+	region   string
+	profile  string
+	endpoint string
+}
+
+// parseRouteAddress parses the route address, [profile@]region[/endpoint],
+// e.g. audit@us-east-1/https://localhost:4567. The region, the profile and
+// the endpoint fall back to their options.
+func parseRouteAddress(route *router.Route) routeAddress {
+	var addr routeAddress
+	if route != nil {
+		host := route.Address
+		if i := strings.Index(host, "/"); i >= 0 {
+			host, addr.endpoint = host[:i], host[i+1:]
+		}
+		if i := strings.LastIndex(host, "@"); i >= 0 {
+			addr.profile, host = host[:i], host[i+1:]
+		}
+		addr.region = host
+	}
+
+	if addr.region == "" {
+		addr.region = routeOpt(route, "KINESIS_REGION")
+	}
+	if addr.profile == "" {
+		addr.profile = routeOpt(route, "KINESIS_PROFILE")
+	}
+	if addr.endpoint == "" {
+		addr.endpoint = routeOpt(route, "KINESIS_ENDPOINT")
+	}
+
+	return addr
+}
+
+// routeID returns the ID of the route, if any.
+func routeID(route *router.Route) string {
+	if route == nil {
+		return ""
+	}
+
+	return route.ID
+}
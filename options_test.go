@@ -0,0 +1,112 @@
+package kinesis
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/gliderlabs/logspout/router"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteOpt(t *testing.T) {
+	os.Setenv("KINESIS_STREAM_TEMPLATE", "env")
+	defer os.Unsetenv("KINESIS_STREAM_TEMPLATE")
+
+	assert.Equal(t, "env", routeOpt(nil, "KINESIS_STREAM_TEMPLATE"))
+
+	route := &router.Route{Options: map[string]string{"stream_template": "route"}}
+	assert.Equal(t, "route", routeOpt(route, "KINESIS_STREAM_TEMPLATE"))
+	assert.Equal(t, "", routeOpt(route, "KINESIS_PARTITION_KEY_TEMPLATE"))
+}
+
+func TestGetOpts(t *testing.T) {
+	route := &router.Route{Options: map[string]string{
+		"pending_limit":    "10",
+		"shutdown_timeout": "1m",
+		"retry_limit":      "many",
+	}}
+
+	assert.Equal(t, 10, getIntOpt(route, "KINESIS_PENDING_LIMIT", DefaultPendingLimit))
+	assert.Equal(t, DefaultRetryLimit, getIntOpt(route, "KINESIS_RETRY_LIMIT", DefaultRetryLimit))
+	assert.Equal(t, time.Minute, getDurationOpt(route, "KINESIS_SHUTDOWN_TIMEOUT", DefaultShutdownTimeout))
+}
+
+func TestNewAdapter_RouteOptions(t *testing.T) {
+	route := &router.Route{
+		Address: "eu-west-1",
+		Options: map[string]string{
+			"stream_template":        "{{ .Container.Name }}",
+			"partition_key_template": "{{ .Container.ID }}",
+			"stream_tag":             "false",
+			"endpoint":               "http://localhost:4567",
+			"pending_limit":          "10",
+			"debug":                  "true",
+		},
+	}
+
+	a, err := newAdapter(route, nil)
+	assert.Nil(t, err)
+	c := a.Config.Client.(*client)
+	assert.Equal(t, "eu-west-1", aws.StringValue(c.kinesis.Config.Region))
+	assert.Equal(t, "http://localhost:4567", aws.StringValue(c.kinesis.Config.Endpoint))
+	assert.Equal(t, 10, a.Config.PendingLimit)
+	assert.True(t, a.Config.SkipTag)
+	assert.True(t, a.Config.Debug)
+
+	// The debug logs of a route don't turn on those of the others.
+	delete(route.Options, "debug")
+	a, err = newAdapter(route, nil)
+	assert.Nil(t, err)
+	assert.False(t, a.Config.Debug)
+
+	_, err = newAdapter(&router.Route{}, nil)
+	assert.IsType(t, &MissingEnvVarError{}, err)
+}
+
+func TestParseRouteAddress(t *testing.T) {
+	addr := parseRouteAddress(&router.Route{Address: "audit@us-east-1/https://localhost:4567"})
+	assert.Equal(t, routeAddress{region: "us-east-1", profile: "audit", endpoint: "https://localhost:4567"}, addr)
+
+	addr = parseRouteAddress(&router.Route{
+		Address: "eu-west-1",
+		Options: map[string]string{"profile": "audit", "endpoint": "http://localhost:4567"},
+	})
+	assert.Equal(t, routeAddress{region: "eu-west-1", profile: "audit", endpoint: "http://localhost:4567"}, addr)
+
+	os.Setenv("KINESIS_REGION", "us-west-2")
+	defer os.Unsetenv("KINESIS_REGION")
+	assert.Equal(t, "us-west-2", parseRouteAddress(&router.Route{}).region)
+
+	// The region option wins over the environment.
+	addr = parseRouteAddress(&router.Route{Options: map[string]string{"region": "ap-south-1"}})
+	assert.Equal(t, "ap-south-1", addr.region)
+}
+
+func TestTmplOptions(t *testing.T) {
+	options, err := tmplOptions(&router.Route{Options: map[string]string{"template_missingkey": "error"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"missingkey=error"}, options)
+
+	_, err = tmplOptions(&router.Route{Options: map[string]string{"template_missingkey": "panic"}})
+	assert.IsType(t, &UnknownMissingKeyError{}, err)
+}
+
+func TestParseTmpl_StrictLabel(t *testing.T) {
+	m := &router.Message{Container: labeledContainer(map[string]string{"app": "abc"})}
+
+	tmpl, _ := parseTmpl(`{{ label .Container "team" }}`)
+	value, err := executeTmpl(tmpl, m)
+	assert.Nil(t, err)
+	assert.Equal(t, "", value)
+
+	tmpl, _ = parseTmpl(`{{ label .Container "team" }}`, "missingkey=error")
+	_, err = executeTmpl(tmpl, m)
+	assert.NotNil(t, err)
+
+	tmpl, _ = parseTmpl(`{{ label .Container "app" }}`, "missingkey=error")
+	value, err = executeTmpl(tmpl, m)
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", value)
+}
@@ -0,0 +1,114 @@
+package kinesis
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// The labels a container can set to override the settings of its logs.
+const (
+	StreamLabel       = "kinesis.stream"
+	PartitionKeyLabel = "kinesis.partition_key"
+	FormatLabel       = "kinesis.format"
+	ExcludeLabel      = "kinesis.exclude"
+	SampleRateLabel   = "kinesis.sample_rate"
+)
+
+// InvalidLabelError is returned when a kinesis label of a container has an
+// invalid value, the label is then ignored.
+type InvalidLabelError struct {
+	Container string
+	Label     string
+	Value     string
+	Err       error
+}
+
+func (e *InvalidLabelError) Error() string {
+	return fmt.Sprintf("invalid label, ignoring it. container: %s, label: %s, value: %q, %s",
+		e.Container, e.Label, e.Value, e.Err)
+}
+
+// overrides holds the settings of the logs of a container, from its labels.
+type overrides struct {
+	// stream replaces the stream name template if set.
+	stream string
+	// pKeyTmpl and formatter replace the ones of the config if set.
+	pKeyTmpl  *template.Template
+	formatter Formatter
+	// exclude drops all the logs, and sampleRate keeps only this ratio of
+	// the logs.
+	exclude    bool
+	sampleRate float64
+	// seen is the last time the container logged.
+	seen time.Time
+}
+
+// newOverrides resolves the overrides of the container labels. The invalid
+// labels are ignored, and the first one is returned as an error.
+func newOverrides(c *docker.Container, config *Config) (*overrides, error) {
+	o := &overrides{
+		stream:     label(c, StreamLabel),
+		exclude:    label(c, ExcludeLabel) == "true",
+		sampleRate: 1,
+		seen:       time.Now(),
+	}
+
+	var labelErr error
+	invalid := func(key string, err error) {
+		if labelErr != nil {
+			return
+		}
+
+		labelErr = &InvalidLabelError{
+			Container: c.ID,
+			Label:     key,
+			Value:     label(c, key),
+			Err:       err,
+		}
+	}
+
+	if value := label(c, PartitionKeyLabel); value != "" {
+		tmpl, err := parseTmpl(value, config.TmplOptions...)
+		if err != nil {
+			invalid(PartitionKeyLabel, err)
+		}
+		o.pKeyTmpl = tmpl
+	}
+
+	if value := label(c, FormatLabel); value != "" {
+		formatter, err := NewFormatter(value, config.RecordLabels, config.RecordEnv)
+		if err != nil {
+			invalid(FormatLabel, err)
+		}
+		o.formatter = formatter
+	}
+
+	if value := label(c, SampleRateLabel); value != "" {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err == nil && (rate < 0 || rate > 1) {
+			err = fmt.Errorf("the rate should be between 0 and 1")
+		}
+
+		if err != nil {
+			invalid(SampleRateLabel, err)
+		} else {
+			o.sampleRate = rate
+		}
+	}
+
+	return o, labelErr
+}
+
+// keep tells if a message of the container should be sent.
+func (o *overrides) keep() bool {
+	if o.exclude {
+		return false
+	}
+
+	return o.sampleRate >= 1 || rand.Float64() < o.sampleRate
+}
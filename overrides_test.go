@@ -0,0 +1,104 @@
+package kinesis
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+	"github.com/stretchr/testify/assert"
+)
+
+func labeledContainer(labels map[string]string) *docker.Container {
+	return &docker.Container{
+		ID:     "123",
+		Name:   "app",
+		Config: &docker.Config{Labels: labels},
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	c := labeledContainer(map[string]string{
+		StreamLabel:       "audit",
+		PartitionKeyLabel: "{{ .Container.Name }}",
+		FormatLabel:       "json",
+		SampleRateLabel:   "0.5",
+	})
+
+	o, err := newOverrides(c, &Config{})
+	assert.Nil(t, err)
+	assert.Equal(t, "audit", o.stream)
+	assert.NotNil(t, o.pKeyTmpl)
+	assert.IsType(t, &jsonFormatter{}, o.formatter)
+	assert.False(t, o.exclude)
+	assert.Equal(t, 0.5, o.sampleRate)
+}
+
+func TestOverrides_Invalid(t *testing.T) {
+	c := labeledContainer(map[string]string{
+		FormatLabel:     "xml",
+		SampleRateLabel: "2",
+	})
+
+	o, err := newOverrides(c, &Config{})
+	assert.IsType(t, &InvalidLabelError{}, err)
+	assert.Nil(t, o.formatter)
+	assert.Equal(t, float64(1), o.sampleRate)
+}
+
+func TestOverrides_Keep(t *testing.T) {
+	assert.True(t, (&overrides{sampleRate: 1}).keep())
+	assert.False(t, (&overrides{sampleRate: 0}).keep())
+	assert.False(t, (&overrides{sampleRate: 1, exclude: true}).keep())
+}
+
+func TestAdapter_RouteExcluded(t *testing.T) {
+	tmpl, _ := parseTmpl("{{ .Container.Name }}")
+	a := &Adapter{
+		Streams:    make(map[string]*Stream),
+		StreamTmpl: tmpl,
+		Config:     &Config{},
+		overrides:  make(map[string]*overrides),
+	}
+
+	m := &router.Message{Container: labeledContainer(map[string]string{ExcludeLabel: "true"})}
+	a.route(m)
+	assert.Len(t, a.Streams, 0)
+	assert.Len(t, a.overrides, 1)
+}
+
+func TestBuffer_Override(t *testing.T) {
+	pKeyTmpl, _ := parseTmpl("{{ .Container.ID }}")
+	config := &Config{PKeyTmpl: pKeyTmpl}
+	m := &router.Message{
+		Container: labeledContainer(map[string]string{PartitionKeyLabel: "{{ .Container.Name }}"}),
+		Data:      "hello",
+	}
+
+	o, err := newOverrides(m.Container, config)
+	assert.Nil(t, err)
+
+	b := newBuffer(config, "abc")
+	b.override(o)
+
+	e, err := b.entry(m)
+	assert.Nil(t, err)
+	assert.Equal(t, "app", aws.StringValue(e.PartitionKey))
+}
+
+func TestStream_WriteOverridden(t *testing.T) {
+	m := &router.Message{
+		Container: labeledContainer(map[string]string{PartitionKeyLabel: "{{ .Container.Name }}"}),
+		Data:      "hello",
+	}
+	o, _ := newOverrides(m.Container, &Config{})
+
+	// The writer uses the overrides resolved by the adapter, also once the
+	// pending messages are replayed.
+	s := NewStream(StreamSpec{Name: "abc"}, nil)
+	s.client = &fakeClient{}
+	assert.Nil(t, s.writeOverridden(m, o))
+	assert.True(t, s.replay())
+	assert.True(t, s.writers["123"].buffer.pKeyTmpl == o.pKeyTmpl)
+	s.stop()
+}
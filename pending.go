@@ -0,0 +1,120 @@
+package kinesis
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+const (
+	// DefaultPendingLimit is the default maximum number of messages held
+	// while a stream isn't ready.
+	DefaultPendingLimit int = 1000
+
+	// DefaultPendingSizeLimit is the default maximum size of the messages held
+	// while a stream isn't ready.
+	DefaultPendingSizeLimit int = 1 * 1024 * 1024 // 1MB
+)
+
+// PendingOverflowError is returned when messages are dropped because the
+// pending queue of a stream that isn't ready is full.
+type PendingOverflowError struct {
+	Stream string
+	Count  int
+}
+
+func (e *PendingOverflowError) Error() string {
+	return fmt.Sprintf("pending queue full, messages dropped! stream: %s, # items: %d", e.Stream, e.Count)
+}
+
+// pendingMessage is a queued message, with the overrides of its container.
+type pendingMessage struct {
+	message   *router.Message
+	overrides *overrides
+}
+
+// pendingQueue holds the messages of a stream until it's ready. Its length is
+// read atomically by the status API, without the lock of the stream.
+type pendingQueue struct {
+	messages  []pendingMessage
+	length    int64
+	byteSize  int
+	dropped   int
+	reported  int
+	limit     int
+	sizeLimit int
+}
+
+func newPendingQueue(limit, sizeLimit int) *pendingQueue {
+	if limit <= 0 {
+		limit = DefaultPendingLimit
+	}
+	if sizeLimit <= 0 {
+		sizeLimit = DefaultPendingSizeLimit
+	}
+
+	return &pendingQueue{
+		messages:  make([]pendingMessage, 0),
+		limit:     limit,
+		sizeLimit: sizeLimit,
+	}
+}
+
+// push queues the message, or drops and counts it if the queue is full.
+func (q *pendingQueue) push(m *router.Message, o *overrides) bool {
+	if !q.fits(m) {
+		q.dropped++
+		return false
+	}
+
+	q.messages = append(q.messages, pendingMessage{message: m, overrides: o})
+	q.byteSize += len(m.Data)
+	atomic.StoreInt64(&q.length, int64(len(q.messages)))
+	return true
+}
+
+// fits tells if the message can be queued without going over the limits.
+func (q *pendingQueue) fits(m *router.Message) bool {
+	return len(q.messages)+1 <= q.limit && q.byteSize+len(m.Data) <= q.sizeLimit
+}
+
+// shift drops and counts the oldest message, and returns false if the queue
+// is empty.
+func (q *pendingQueue) shift() bool {
+	if len(q.messages) == 0 {
+		return false
+	}
+
+	q.byteSize -= len(q.messages[0].message.Data)
+	q.messages = q.messages[1:]
+	q.dropped++
+	atomic.StoreInt64(&q.length, int64(len(q.messages)))
+	return true
+}
+
+// report returns the number of messages dropped since the last report, and
+// marks them reported.
+func (q *pendingQueue) report() int {
+	dropped := q.dropped - q.reported
+	q.reported = q.dropped
+	return dropped
+}
+
+// drain returns the queued messages in order, and the number of messages
+// dropped and not reported yet, and empties the queue.
+func (q *pendingQueue) drain() ([]pendingMessage, int) {
+	messages, dropped := q.messages, q.report()
+
+	q.messages = make([]pendingMessage, 0)
+	q.byteSize = 0
+	q.dropped = 0
+	q.reported = 0
+	atomic.StoreInt64(&q.length, 0)
+
+	return messages, dropped
+}
+
+func (q *pendingQueue) len() int {
+	return int(atomic.LoadInt64(&q.length))
+}
@@ -0,0 +1,256 @@
+package kinesis
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/gliderlabs/logspout/router"
+)
+
+const (
+	// DefaultReshardWindow is the default window over which the throughput
+	// of a stream is measured.
+	DefaultReshardWindow = time.Minute
+
+	// DefaultReshardCooldown is the default minimum time between two
+	// reshardings of a stream.
+	DefaultReshardCooldown = 10 * time.Minute
+
+	// DefaultReshardMaxShards is the default maximum number of shards a stream
+	// is scaled up to.
+	DefaultReshardMaxShards int64 = 8
+
+	// DefaultReshardThrottleRate is the default number of throttled records
+	// per second above which a stream is scaled up.
+	DefaultReshardThrottleRate = 1
+
+	// DefaultReshardBytesRate is the default number of bytes per second and
+	// per shard above which a stream is scaled up, 80% of a shard capacity.
+	DefaultReshardBytesRate = 800 * 1024
+
+	// DefaultReshardScaleDownAfter is the default time a stream must stay
+	// under the scale down rate before being scaled down.
+	DefaultReshardScaleDownAfter = 30 * time.Minute
+)
+
+// ManagedTagKey is the tag written to the streams created by the adapter, so
+// they're still resharded after a restart, unlike the streams managed
+// elsewhere.
+const ManagedTagKey = "logspout-kinesis:managed"
+
+// ReshardError is returned when a stream couldn't be resharded.
+type ReshardError struct {
+	Stream string
+	From   int64
+	To     int64
+	Err    error
+}
+
+func (e *ReshardError) Error() string {
+	return fmt.Sprintf("couldn't reshard stream: %s, shards: %d -> %d, %s", e.Stream, e.From, e.To, e.Err)
+}
+
+// ReshardConfig holds the thresholds of the resharding of the streams. Zero
+// values use the defaults.
+type ReshardConfig struct {
+	// Window is the period over which the throughput is measured.
+	Window time.Duration
+
+	// Cooldown is the minimum time between two reshardings.
+	Cooldown time.Duration
+
+	// MaxShards bounds the number of shards when scaling up.
+	MaxShards int64
+
+	// ThrottleRate is the number of throttled records per second, and
+	// BytesRate the number of bytes per second and per shard, above which
+	// the stream is scaled up.
+	ThrottleRate int
+	BytesRate    int
+
+	// ScaleDownRate is the number of bytes per second and per shard under
+	// which the stream is scaled down, once it stayed under it for
+	// ScaleDownAfter. Zero never scales down.
+	ScaleDownRate  int
+	ScaleDownAfter time.Duration
+}
+
+// reshardConfig reads the resharding settings from the environment, or
+// returns nil if the resharding is disabled.
+func reshardConfig(route *router.Route) *ReshardConfig {
+	if routeOpt(route, "KINESIS_RESHARD") != "true" {
+		return nil
+	}
+
+	return &ReshardConfig{
+		Window:         getDurationOpt(route, "KINESIS_RESHARD_WINDOW", DefaultReshardWindow),
+		Cooldown:       getDurationOpt(route, "KINESIS_RESHARD_COOLDOWN", DefaultReshardCooldown),
+		MaxShards:      int64(getIntOpt(route, "KINESIS_RESHARD_MAX_SHARDS", int(DefaultReshardMaxShards))),
+		ThrottleRate:   getIntOpt(route, "KINESIS_RESHARD_THROTTLE_RATE", DefaultReshardThrottleRate),
+		BytesRate:      getIntOpt(route, "KINESIS_RESHARD_BYTES_RATE", DefaultReshardBytesRate),
+		ScaleDownRate:  getIntOpt(route, "KINESIS_RESHARD_SCALE_DOWN_RATE", 0),
+		ScaleDownAfter: getDurationOpt(route, "KINESIS_RESHARD_SCALE_DOWN_AFTER", DefaultReshardScaleDownAfter),
+	}
+}
+
+// resharder measures the throughput of a stream, and updates its shard count
+// when it's throttled or underused.
+type resharder struct {
+	client      Client
+	stream      string
+	config      ReshardConfig
+	shards      int64
+	throttled   int64
+	bytes       int64
+	lastReshard time.Time
+	lowSince    time.Time
+	now         func() time.Time
+	debug       debugLogger
+}
+
+func newResharder(client Client, stream string, shards int64, config *ReshardConfig) *resharder {
+	r := &resharder{
+		client: client,
+		stream: stream,
+		config: *config,
+		shards: shards,
+		now:    time.Now,
+	}
+
+	if r.config.Window <= 0 {
+		r.config.Window = DefaultReshardWindow
+	}
+	if r.config.Cooldown <= 0 {
+		r.config.Cooldown = DefaultReshardCooldown
+	}
+	if r.config.MaxShards <= 0 {
+		r.config.MaxShards = DefaultReshardMaxShards
+	}
+	if r.config.ThrottleRate <= 0 {
+		r.config.ThrottleRate = DefaultReshardThrottleRate
+	}
+	if r.config.BytesRate <= 0 {
+		r.config.BytesRate = DefaultReshardBytesRate
+	}
+	if r.config.ScaleDownAfter <= 0 {
+		r.config.ScaleDownAfter = DefaultReshardScaleDownAfter
+	}
+
+	return r
+}
+
+// run checks the throughput at the end of every window, until quit is
+// closed.
+func (r *resharder) run(quit <-chan struct{}) {
+	t := time.NewTicker(r.config.Window)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			ErrorHandler(r.check())
+		case <-quit:
+			return
+		}
+	}
+}
+
+// record counts the bytes sent and the records throttled by a PutRecords
+// request.
+func (r *resharder) record(inp *kinesis.PutRecordsInput, out *kinesis.PutRecordsOutput) {
+	var bytes, throttled int64
+	for i, e := range inp.Records {
+		if out != nil && i < len(out.Records) && out.Records[i].ErrorCode != nil {
+			if *out.Records[i].ErrorCode == kinesis.ErrCodeProvisionedThroughputExceededException {
+				throttled++
+			}
+			continue
+		}
+
+		bytes += int64(entrySize(e))
+	}
+
+	atomic.AddInt64(&r.bytes, bytes)
+	atomic.AddInt64(&r.throttled, throttled)
+}
+
+// check measures the throughput over the last window, and doubles the shard
+// count when above the thresholds, or halves it after a sustained low usage.
+func (r *resharder) check() error {
+	// A stream without open shards can't be measured nor resharded.
+	if r.shards <= 0 {
+		return nil
+	}
+
+	now := r.now()
+	seconds := r.config.Window.Seconds()
+	throttled := float64(atomic.SwapInt64(&r.throttled, 0)) / seconds
+	bytes := float64(atomic.SwapInt64(&r.bytes, 0)) / seconds / float64(r.shards)
+
+	high := throttled >= float64(r.config.ThrottleRate) || bytes >= float64(r.config.BytesRate)
+	low := !high && throttled == 0 && bytes < float64(r.config.ScaleDownRate)
+
+	switch {
+	case !low:
+		r.lowSince = time.Time{}
+	case r.lowSince.IsZero():
+		r.lowSince = now.Add(-r.config.Window)
+	}
+
+	r.debug.printf("stream throughput, stream: %s, shards: %d, bytes/s/shard: %.0f, throttled/s: %.2f",
+		r.stream, r.shards, bytes, throttled)
+
+	if !r.lastReshard.IsZero() && now.Sub(r.lastReshard) < r.config.Cooldown {
+		return nil
+	}
+
+	var target int64
+	switch {
+	case high && r.shards < r.config.MaxShards:
+		// UpdateShardCount can at most double the shard count.
+		target = r.shards * 2
+		if target > r.config.MaxShards {
+			target = r.config.MaxShards
+		}
+	case low && r.shards > 1 && now.Sub(r.lowSince) >= r.config.ScaleDownAfter:
+		// Nor can it go under half of the shard count.
+		target = (r.shards + 1) / 2
+	default:
+		return nil
+	}
+
+	err := r.client.Reshard(&kinesis.UpdateShardCountInput{
+		StreamName:       aws.String(r.stream),
+		TargetShardCount: aws.Int64(target),
+		ScalingType:      aws.String(kinesis.ScalingTypeUniformScaling),
+	})
+	if err != nil {
+		return &ReshardError{Stream: r.stream, From: r.shards, To: target, Err: err}
+	}
+
+	log.Printf("resharding! stream: %s, shards: %d -> %d", r.stream, r.shards, target)
+
+	r.shards = target
+	r.lastReshard = now
+	r.lowSince = time.Time{}
+	return nil
+}
+
+// reshardClient records the throughput of the PutRecords requests.
+type reshardClient struct {
+	Client
+	resharder *resharder
+}
+
+func (c *reshardClient) PutRecords(inp *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	out, err := c.Client.PutRecords(inp)
+	if err == nil {
+		c.resharder.record(inp, out)
+	}
+
+	return out, err
+}
@@ -0,0 +1,191 @@
+package kinesis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func testResharder(client Client, shards int64, config *ReshardConfig) (*resharder, *fakeClock) {
+	clock := &fakeClock{t: time.Now()}
+	r := newResharder(client, "abc", shards, config)
+	r.now = clock.now
+	return r, clock
+}
+
+func TestResharder_Record(t *testing.T) {
+	r, _ := testResharder(&fakeClient{}, 1, &ReshardConfig{})
+
+	r.record(testInput("aaaa", "bbbb", "cccc"), &kinesis.PutRecordsOutput{
+		Records: []*kinesis.PutRecordsResultEntry{
+			{},
+			{ErrorCode: aws.String(kinesis.ErrCodeProvisionedThroughputExceededException)},
+			{ErrorCode: aws.String("InternalFailure")},
+		},
+	})
+
+	// The data and the partition key of the successful record.
+	assert.Equal(t, int64(7), r.bytes)
+	assert.Equal(t, int64(1), r.throttled)
+}
+
+func TestResharder_ScaleUpThrottled(t *testing.T) {
+	client := &fakeClient{}
+	r, clock := testResharder(client, 3, &ReshardConfig{
+		Window:    time.Second,
+		Cooldown:  time.Minute,
+		MaxShards: 4,
+	})
+
+	r.throttled = 5
+	assert.Nil(t, r.check())
+	assert.Equal(t, []int64{4}, client.reshards)
+	assert.Equal(t, int64(4), r.shards)
+
+	// The maximum is reached.
+	clock.t = clock.t.Add(2 * time.Minute)
+	r.throttled = 5
+	assert.Nil(t, r.check())
+	assert.Equal(t, []int64{4}, client.reshards)
+}
+
+func TestResharder_ScaleUpBytesCooldown(t *testing.T) {
+	client := &fakeClient{}
+	r, clock := testResharder(client, 1, &ReshardConfig{
+		Window:    time.Second,
+		Cooldown:  time.Minute,
+		BytesRate: 1000,
+	})
+
+	r.bytes = 1000
+	assert.Nil(t, r.check())
+	assert.Equal(t, []int64{2}, client.reshards)
+
+	// 1000 bytes/s over 2 shards is under the threshold.
+	clock.t = clock.t.Add(2 * time.Minute)
+	r.bytes = 1000
+	assert.Nil(t, r.check())
+	assert.Equal(t, []int64{2}, client.reshards)
+
+	clock.t = clock.t.Add(time.Second)
+	r.bytes = 2000
+	assert.Nil(t, r.check())
+	assert.Equal(t, []int64{2, 4}, client.reshards)
+
+	// Still cooling down.
+	clock.t = clock.t.Add(time.Second)
+	r.bytes = 4000
+	assert.Nil(t, r.check())
+	assert.Equal(t, []int64{2, 4}, client.reshards)
+}
+
+func TestResharder_ScaleDown(t *testing.T) {
+	client := &fakeClient{}
+	r, clock := testResharder(client, 4, &ReshardConfig{
+		Window:         time.Minute,
+		ScaleDownRate:  100,
+		ScaleDownAfter: 3 * time.Minute,
+	})
+
+	for i := 0; i < 2; i++ {
+		clock.t = clock.t.Add(time.Minute)
+		assert.Nil(t, r.check())
+	}
+	assert.Len(t, client.reshards, 0)
+
+	// A busier window resets the low usage period.
+	clock.t = clock.t.Add(time.Minute)
+	r.bytes = 60 * 400 * 4
+	assert.Nil(t, r.check())
+
+	for i := 0; i < 2; i++ {
+		clock.t = clock.t.Add(time.Minute)
+		assert.Nil(t, r.check())
+	}
+	assert.Len(t, client.reshards, 0)
+
+	clock.t = clock.t.Add(time.Minute)
+	assert.Nil(t, r.check())
+	assert.Equal(t, []int64{2}, client.reshards)
+}
+
+func TestResharder_Error(t *testing.T) {
+	client := &fakeClient{err: ErrFirehoseUnsupported}
+	r, _ := testResharder(client, 1, &ReshardConfig{})
+
+	r.throttled = int64(DefaultReshardWindow.Seconds())
+	err := r.check()
+	assert.IsType(t, &ReshardError{}, err)
+	assert.Equal(t, int64(1), r.shards)
+}
+
+func TestStream_ReshardManagedOnly(t *testing.T) {
+	s := NewStream(StreamSpec{Name: "abc"}, &Config{Reshard: &ReshardConfig{}, SkipCreate: true})
+	s.client = &fakeClient{created: true, status: "ACTIVE"}
+	assert.Nil(t, s.waitActive())
+	s.startResharder()
+	assert.Nil(t, s.resharder)
+
+	// The stream created by the adapter is tagged as managed.
+	s = NewStream(StreamSpec{Name: "abc"}, &Config{Reshard: &ReshardConfig{}})
+	fk := &fakeClient{status: "ACTIVE"}
+	s.client = fk
+	assert.Nil(t, s.setup())
+	assert.Equal(t, "true", aws.StringValue(fk.tagged[ManagedTagKey]))
+	s.startResharder()
+	assert.NotNil(t, s.resharder)
+	s.stop()
+
+	// The stream created elsewhere isn't resharded.
+	s = NewStream(StreamSpec{Name: "abc"}, &Config{Reshard: &ReshardConfig{}})
+	s.client = &fakeClient{created: true, status: "ACTIVE", shardCount: 4}
+	assert.Nil(t, s.setup())
+	s.startResharder()
+	assert.Nil(t, s.resharder)
+
+	// The stream created by the adapter before a restart is resharded from
+	// its current shard count.
+	s = NewStream(StreamSpec{Name: "abc"}, &Config{Reshard: &ReshardConfig{}})
+	s.client = &fakeClient{
+		created:    true,
+		status:     "ACTIVE",
+		shardCount: 4,
+		tags:       map[string]string{ManagedTagKey: "true"},
+	}
+	assert.Nil(t, s.setup())
+	s.startResharder()
+	assert.NotNil(t, s.resharder)
+	assert.Equal(t, int64(4), s.resharder.shards)
+	s.stop()
+
+	// Nor without open shards.
+	s = NewStream(StreamSpec{Name: "abc"}, &Config{Reshard: &ReshardConfig{}})
+	s.client = &fakeClient{
+		created: true,
+		status:  "ACTIVE",
+		tags:    map[string]string{ManagedTagKey: "true"},
+	}
+	assert.Nil(t, s.setup())
+	s.startResharder()
+	assert.Nil(t, s.resharder)
+}
+
+func TestResharder_NoShards(t *testing.T) {
+	client := &fakeClient{}
+	r, _ := testResharder(client, 0, &ReshardConfig{})
+	r.throttled = 100
+
+	assert.Nil(t, r.check())
+	assert.Len(t, client.reshards, 0)
+}
@@ -0,0 +1,582 @@
+package kinesis
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/gliderlabs/logspout/router"
+)
+
+const (
+	// DefaultSpoolMaxSize is the default maximum size of the spool of a
+	// stream, in bytes.
+	DefaultSpoolMaxSize = 1 << 30
+
+	// DefaultSpoolSegmentSize is the default size of the segment files of a
+	// spool, in bytes.
+	DefaultSpoolSegmentSize = 64 << 20
+
+	spoolMaxDelay = 30 * time.Second
+
+	spoolSegmentExt = ".seg"
+	spoolCheckpoint = "checkpoint"
+	// spoolHeaderSize is the size of the header of an entry, its length
+	// and its CRC-32.
+	spoolHeaderSize = 8
+)
+
+// SpoolFullError is returned when an input doesn't fit in the spool, it's
+// then dropped.
+type SpoolFullError struct {
+	Stream string
+	Count  int
+}
+
+func (e *SpoolFullError) Error() string {
+	return fmt.Sprintf("spool full, input dropped! stream: %s, # items: %d", e.Stream, e.Count)
+}
+
+// SpoolError is returned when the spool of a stream can't be read or
+// written.
+type SpoolError struct {
+	Stream string
+	Err    error
+}
+
+func (e *SpoolError) Error() string {
+	return fmt.Sprintf("spool error, stream: %s, %s", e.Stream, e.Err)
+}
+
+// SpoolWriteError is returned when an input couldn't be written to the spool
+// for another reason than the spool being full, it's then dropped.
+type SpoolWriteError struct {
+	Stream string
+	Count  int
+	Err    error
+}
+
+func (e *SpoolWriteError) Error() string {
+	return fmt.Sprintf("couldn't spool the input, input dropped! stream: %s, # items: %d, %s", e.Stream, e.Count, e.Err)
+}
+
+// SpoolConfig holds the settings of the spools of the streams.
+type SpoolConfig struct {
+	// Dir holds a directory per route, named Route, holding a directory per
+	// stream.
+	Dir   string
+	Route string
+
+	// MaxSize is the maximum size of the spool of a stream, and
+	// SegmentSize the size of its files. Zero values use the defaults.
+	MaxSize     int
+	SegmentSize int
+}
+
+// spoolConfig reads the spool settings of the route, or returns nil if the
+// spool is disabled.
+func spoolConfig(route *router.Route) *SpoolConfig {
+	dir := routeOpt(route, "KINESIS_SPOOL_DIR")
+	if dir == "" {
+		return nil
+	}
+
+	return &SpoolConfig{
+		Dir:         dir,
+		Route:       spoolRoute(route),
+		MaxSize:     getIntOpt(route, "KINESIS_SPOOL_MAX_SIZE", DefaultSpoolMaxSize),
+		SegmentSize: getIntOpt(route, "KINESIS_SPOOL_SEGMENT_SIZE", DefaultSpoolSegmentSize),
+	}
+}
+
+// spoolInput writes the input to the spool, counting its records as spooled,
+// or as dropped and reports them once if it can't.
+func spoolInput(sp *spool, metrics *streamMetrics, input *kinesis.PutRecordsInput) bool {
+	err := sp.append(input)
+	if err == nil {
+		metrics.spooled(len(input.Records))
+		return true
+	}
+
+	metrics.dropped(len(input.Records))
+	if _, ok := err.(*SpoolFullError); !ok {
+		err = &SpoolWriteError{Stream: *input.StreamName, Count: len(input.Records), Err: err}
+	}
+	ErrorHandler(err)
+	return false
+}
+
+// spoolRoute names the spool directory of the route: its ID if set, as for
+// the routes of the routes API, else a hash of its settings, since logspout
+// gives a random ID to the routes of its command line only after creating
+// their adapter. The directory of a route is then the same after a restart.
+func spoolRoute(route *router.Route) string {
+	if route == nil {
+		return ""
+	}
+	if route.ID != "" {
+		return route.ID
+	}
+
+	names := make([]string, 0, len(route.Options))
+	for name := range route.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha1.New()
+	fmt.Fprintf(h, "%s://%s\n", route.Adapter, route.Address)
+	for _, name := range names {
+		fmt.Fprintf(h, "%s=%s\n", name, route.Options[name])
+	}
+	fmt.Fprintf(h, "%s\n%s\n%s\n", route.FilterID, route.FilterName, strings.Join(route.FilterSources, ","))
+
+	return fmt.Sprintf("%x", h.Sum(nil))[:12]
+}
+
+// spool is an append-only queue of inputs on disk, split into segment files.
+// The checkpoint file holds the position of the next input to replay, so
+// that the replay resumes after a restart.
+type spool struct {
+	mutex       sync.Mutex
+	stream      string
+	dir         string
+	maxSize     int64
+	segmentSize int64
+
+	// segments are the sequence numbers of the segment files, in order, and
+	// sizes their sizes.
+	segments []int64
+	sizes    map[int64]int64
+	size     int64
+	// sealed closes the last segment to the appends.
+	sealed bool
+
+	// readSeq and readOffset are the position of the next input to replay,
+	// and peeked the length of the entry of the input being replayed.
+	readSeq    int64
+	readOffset int64
+	peeked     int64
+
+	// appended is signaled when an input is appended.
+	appended chan struct{}
+}
+
+// openSpool opens the spool in dir, creating the directory if needed, and
+// resumes from its checkpoint.
+func openSpool(stream, dir string, config *SpoolConfig) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &spool{
+		stream:      stream,
+		dir:         dir,
+		maxSize:     int64(config.MaxSize),
+		segmentSize: int64(config.SegmentSize),
+		sizes:       make(map[int64]int64),
+		appended:    make(chan struct{}, 1),
+	}
+	if s.maxSize <= 0 {
+		s.maxSize = DefaultSpoolMaxSize
+	}
+	if s.segmentSize <= 0 {
+		s.segmentSize = DefaultSpoolSegmentSize
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fi := range files {
+		name := fi.Name()
+		if !strings.HasSuffix(name, spoolSegmentExt) {
+			continue
+		}
+
+		seq, err := strconv.ParseInt(strings.TrimSuffix(name, spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, seq)
+		s.sizes[seq] = fi.Size()
+		s.size += fi.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	if len(s.segments) > 0 {
+		s.readSeq = s.segments[0]
+	}
+	if err := s.readCheckpoint(); err != nil {
+		return nil, err
+	}
+
+	// The segments before the checkpoint were replayed.
+	for len(s.segments) > 0 && s.segments[0] < s.readSeq {
+		if err := s.removeSegment(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// append writes the input at the end of the spool, in a new segment if it
+// doesn't fit in the last one.
+func (s *spool) append(inp *kinesis.PutRecordsInput) error {
+	payload, err := json.Marshal(inp)
+	if err != nil {
+		return err
+	}
+
+	entry := make([]byte, spoolHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(entry[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(entry[4:8], crc32.ChecksumIEEE(payload))
+	copy(entry[spoolHeaderSize:], payload)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.size+int64(len(entry)) > s.maxSize {
+		return &SpoolFullError{Stream: s.stream, Count: len(inp.Records)}
+	}
+
+	last := s.lastSegment()
+	if last < 0 || s.sealed || (s.sizes[last] > 0 && s.sizes[last]+int64(len(entry)) > s.segmentSize) {
+		last++
+		if last == 0 {
+			last = s.readSeq
+		}
+		s.segments = append(s.segments, last)
+		s.sizes[last] = 0
+		s.sealed = false
+	}
+
+	f, err := os.OpenFile(s.segmentPath(last), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(entry); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	s.sizes[last] += int64(len(entry))
+	s.size += int64(len(entry))
+
+	select {
+	case s.appended <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// empty tells if all the inputs were replayed.
+func (s *spool) empty() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.emptyLocked()
+}
+
+func (s *spool) emptyLocked() bool {
+	return len(s.segments) == 0 ||
+		(s.readSeq == s.lastSegment() && s.readOffset >= s.sizes[s.readSeq])
+}
+
+// bytes returns the size of the segment files.
+func (s *spool) bytes() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.size
+}
+
+// peek returns the next input to replay, or nil if the spool is empty. A
+// corrupted segment is skipped, and the error returned.
+func (s *spool) peek() (*kinesis.PutRecordsInput, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for !s.emptyLocked() {
+		if s.readOffset >= s.sizes[s.readSeq] {
+			if err := s.removeSegment(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		inp, n, err := s.readEntry(s.readSeq, s.readOffset)
+		if err != nil {
+			s.skipSegment()
+			return nil, err
+		}
+
+		s.peeked = n
+		return inp, nil
+	}
+
+	return nil, nil
+}
+
+// commit moves the checkpoint past the input returned by peek, and removes
+// the segments fully replayed.
+func (s *spool) commit() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.readOffset += s.peeked
+	s.peeked = 0
+
+	if s.readOffset >= s.sizes[s.readSeq] {
+		if err := s.removeSegment(); err != nil {
+			return err
+		}
+	}
+
+	return s.writeCheckpoint()
+}
+
+func (s *spool) readEntry(seq, offset int64) (*kinesis.PutRecordsInput, int64, error) {
+	f, err := os.Open(s.segmentPath(seq))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	// An entry may be truncated by a crash while it was written.
+	header := make([]byte, spoolHeaderSize)
+	if n, _ := f.ReadAt(header, offset); n < len(header) {
+		return nil, 0, fmt.Errorf("corrupted segment: %d, truncated entry at offset: %d", seq, offset)
+	}
+
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if offset+spoolHeaderSize+length > s.sizes[seq] {
+		return nil, 0, fmt.Errorf("corrupted segment: %d, truncated entry at offset: %d", seq, offset)
+	}
+
+	payload := make([]byte, length)
+	if n, err := f.ReadAt(payload, offset+spoolHeaderSize); n < len(payload) {
+		return nil, 0, fmt.Errorf("corrupted segment: %d, %s", seq, err)
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, fmt.Errorf("corrupted segment: %d, checksum mismatch", seq)
+	}
+
+	inp := &kinesis.PutRecordsInput{}
+	if err := json.NewDecoder(bytes.NewReader(payload)).Decode(inp); err != nil {
+		return nil, 0, fmt.Errorf("corrupted segment: %d, %s", seq, err)
+	}
+
+	return inp, int64(spoolHeaderSize + len(payload)), nil
+}
+
+// skipSegment gives up on the rest of the segment being replayed. The last
+// segment is closed to the appends, which would follow the corrupted entry.
+func (s *spool) skipSegment() {
+	s.readOffset = s.sizes[s.readSeq]
+	if s.readSeq == s.lastSegment() {
+		s.sealed = true
+	}
+}
+
+// removeSegment removes the segment being replayed, and moves the checkpoint
+// to the start of the next one.
+func (s *spool) removeSegment() error {
+	seq := s.segments[0]
+	if err := os.Remove(s.segmentPath(seq)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	s.size -= s.sizes[seq]
+	delete(s.sizes, seq)
+	s.segments = s.segments[1:]
+	if len(s.segments) == 0 {
+		s.sealed = false
+	}
+
+	s.readSeq = seq + 1
+	if len(s.segments) > 0 {
+		s.readSeq = s.segments[0]
+	}
+	s.readOffset = 0
+
+	return nil
+}
+
+func (s *spool) lastSegment() int64 {
+	if len(s.segments) == 0 {
+		return -1
+	}
+
+	return s.segments[len(s.segments)-1]
+}
+
+func (s *spool) segmentPath(seq int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolSegmentExt))
+}
+
+func (s *spool) readCheckpoint() error {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, spoolCheckpoint))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var seq, offset int64
+	if _, err := fmt.Sscanf(string(data), "%d %d", &seq, &offset); err != nil {
+		return fmt.Errorf("invalid checkpoint: %q, %s", data, err)
+	}
+
+	if seq >= s.readSeq {
+		s.readSeq = seq
+		s.readOffset = offset
+	}
+	// The segment of the checkpoint was replayed and removed.
+	if _, ok := s.sizes[s.readSeq]; !ok {
+		s.readOffset = 0
+	}
+
+	return nil
+}
+
+// writeCheckpoint replaces the checkpoint file atomically.
+func (s *spool) writeCheckpoint() error {
+	path := filepath.Join(s.dir, spoolCheckpoint)
+	tmp := path + ".tmp"
+
+	data := fmt.Sprintf("%d %d\n", s.readSeq, s.readOffset)
+	if err := ioutil.WriteFile(tmp, []byte(data), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// spoolReplayer sends the inputs of a spool in order, waiting for Kinesis to
+// accept an input before sending the next one.
+type spoolReplayer struct {
+	spool       *spool
+	client      Client
+	metrics     *streamMetrics
+	backoffFunc func(attempt int) time.Duration
+	debug       debugLogger
+}
+
+func newSpoolReplayer(sp *spool, client Client, metrics *streamMetrics) *spoolReplayer {
+	return &spoolReplayer{
+		spool:       sp,
+		client:      client,
+		metrics:     metrics,
+		backoffFunc: spoolBackoff,
+	}
+}
+
+// run replays the inputs until quit is closed. The records rejected by
+// Kinesis are sent again until they're accepted, and the checkpoint only
+// moves past an input once all its records are.
+func (r *spoolReplayer) run(quit <-chan struct{}) {
+	var inp *kinesis.PutRecordsInput
+	attempt := 0
+
+	for {
+		if inp == nil {
+			var err error
+			inp, err = r.spool.peek()
+			if err != nil {
+				// The spool may be readable again later, e.g. once the
+				// disk recovers, we don't spin meanwhile.
+				ErrorHandler(&SpoolError{Stream: r.spool.stream, Err: err})
+				attempt++
+				select {
+				case <-time.After(r.backoffFunc(attempt)):
+					continue
+				case <-quit:
+					return
+				}
+			}
+
+			if inp == nil {
+				select {
+				case <-r.spool.appended:
+					continue
+				case <-quit:
+					return
+				}
+			}
+		}
+
+		failed, err := r.send(inp)
+		if err == nil && failed == nil {
+			if err := r.spool.commit(); err != nil {
+				ErrorHandler(&SpoolError{Stream: r.spool.stream, Err: err})
+			}
+
+			r.debug.printf("spooled input replayed, stream: %s", r.spool.stream)
+			inp = nil
+			attempt = 0
+			continue
+		}
+
+		if failed != nil {
+			inp = failed
+		}
+		attempt++
+		r.debug.printf("spool replay failed, stream: %s, attempt: %d, %v", r.spool.stream, attempt, err)
+
+		select {
+		case <-time.After(r.backoffFunc(attempt)):
+		case <-quit:
+			return
+		}
+	}
+}
+
+// send sends the input once, and returns the records rejected by Kinesis if
+// any.
+func (r *spoolReplayer) send(inp *kinesis.PutRecordsInput) (*kinesis.PutRecordsInput, error) {
+	start := time.Now()
+	out, err := r.client.PutRecords(inp)
+	r.metrics.observeLatency(time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+
+	if out == nil || aws.Int64Value(out.FailedRecordCount) == 0 {
+		r.metrics.flushed(len(inp.Records), inputSize(inp))
+		return nil, nil
+	}
+
+	failed, _ := failedRecords(inp, out)
+	r.metrics.flushed(len(inp.Records)-len(failed.Records), inputSize(inp)-inputSize(failed))
+	r.metrics.retried(len(failed.Records))
+
+	return failed, nil
+}
+
+// spoolBackoff returns the delay before replaying an input again, longer
+// than the retries of the flusher as Kinesis may be unreachable.
+func spoolBackoff(attempt int) time.Duration {
+	return jitteredBackoff(retryBaseDelay, spoolMaxDelay, attempt)
+}
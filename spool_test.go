@@ -0,0 +1,301 @@
+package kinesis
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+	"github.com/stretchr/testify/assert"
+)
+
+func testSpool(t *testing.T, config *SpoolConfig) (*spool, func()) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sp, err := openSpool("abc", dir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sp, func() { os.RemoveAll(dir) }
+}
+
+func peekData(t *testing.T, sp *spool) string {
+	inp, err := sp.peek()
+	assert.Nil(t, err)
+	if inp == nil {
+		return ""
+	}
+
+	return string(inp.Records[0].Data)
+}
+
+func TestSpool_Replay(t *testing.T) {
+	// Each input gets its own segment.
+	sp, cleanup := testSpool(t, &SpoolConfig{SegmentSize: 10})
+	defer cleanup()
+
+	assert.True(t, sp.empty())
+	assert.Nil(t, sp.append(testInput("a")))
+	assert.Nil(t, sp.append(testInput("b")))
+	assert.Nil(t, sp.append(testInput("c")))
+	assert.Len(t, sp.segments, 3)
+	assert.False(t, sp.empty())
+
+	for _, data := range []string{"a", "b", "c"} {
+		assert.Equal(t, data, peekData(t, sp))
+		assert.Nil(t, sp.commit())
+	}
+
+	assert.True(t, sp.empty())
+	assert.Equal(t, int64(0), sp.bytes())
+
+	files, _ := filepath.Glob(filepath.Join(sp.dir, "*"+spoolSegmentExt))
+	assert.Len(t, files, 0)
+}
+
+func TestSpool_Checkpoint(t *testing.T) {
+	sp, cleanup := testSpool(t, &SpoolConfig{})
+	defer cleanup()
+
+	assert.Nil(t, sp.append(testInput("a")))
+	assert.Nil(t, sp.append(testInput("b")))
+	assert.Equal(t, "a", peekData(t, sp))
+	assert.Nil(t, sp.commit())
+
+	// The replay resumes after a restart.
+	sp, err := openSpool("abc", sp.dir, &SpoolConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, "b", peekData(t, sp))
+	assert.Nil(t, sp.commit())
+	assert.True(t, sp.empty())
+
+	assert.Nil(t, sp.append(testInput("c")))
+	assert.Equal(t, "c", peekData(t, sp))
+}
+
+func TestSpool_Full(t *testing.T) {
+	sp, cleanup := testSpool(t, &SpoolConfig{MaxSize: 200})
+	defer cleanup()
+
+	assert.Nil(t, sp.append(testInput("a")))
+	assert.IsType(t, &SpoolFullError{}, sp.append(testInput("b")))
+}
+
+func TestSpool_Corrupted(t *testing.T) {
+	sp, cleanup := testSpool(t, &SpoolConfig{})
+	defer cleanup()
+
+	assert.Nil(t, sp.append(testInput("a")))
+
+	// A crash while appending leaves a truncated entry.
+	f, _ := os.OpenFile(sp.segmentPath(sp.lastSegment()), os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte{0, 0, 1})
+	f.Close()
+
+	sp, err := openSpool("abc", sp.dir, &SpoolConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, "a", peekData(t, sp))
+	assert.Nil(t, sp.commit())
+
+	_, err = sp.peek()
+	assert.NotNil(t, err)
+	assert.True(t, sp.empty())
+
+	// The appends go to a new segment.
+	assert.Nil(t, sp.append(testInput("b")))
+	assert.Equal(t, "b", peekData(t, sp))
+}
+
+func TestFlusher_Spool(t *testing.T) {
+	sp, cleanup := testSpool(t, &SpoolConfig{})
+	defer cleanup()
+
+	metrics := newStreamMetrics()
+	f := &flusher{
+		inputs:  make(chan kinesis.PutRecordsInput, 1),
+		metrics: metrics,
+		policy:  Spill,
+		spool:   sp,
+	}
+
+	f.flush(*testInput("a"))
+	f.flush(*testInput("b"))
+	assert.Equal(t, int64(1), metrics.recordsSpooled)
+
+	// The inputs follow the spooled ones.
+	<-f.inputs
+	f.flush(*testInput("c"))
+	assert.Len(t, f.inputs, 0)
+	assert.Equal(t, int64(2), metrics.recordsSpooled)
+	assert.Equal(t, int64(0), metrics.recordsDropped)
+}
+
+func TestFlusher_SpoolFailed(t *testing.T) {
+	sp, cleanup := testSpool(t, &SpoolConfig{})
+	defer cleanup()
+
+	c := &retryClient{
+		outputs: []*kinesis.PutRecordsOutput{
+			{
+				FailedRecordCount: aws.Int64(1),
+				Records: []*kinesis.PutRecordsResultEntry{
+					{SequenceNumber: aws.String("1")},
+					{ErrorCode: aws.String("ProvisionedThroughputExceededException")},
+				},
+			},
+		},
+	}
+	metrics := newStreamMetrics()
+	f := newFlusher(c, flusherConfig{retryLimit: 1, policy: Spill, spool: sp, metrics: metrics}).(*flusher)
+
+	var reported error
+	ErrorHandler = func(err error) {
+		if err != nil {
+			reported = err
+		}
+	}
+	defer func() { ErrorHandler = logErr }()
+
+	f.flush(*testInput("a", "b"))
+	f.flush(*testInput("c"))
+	f.stop()
+	f.start()
+
+	// The input queued after the failed records follows them.
+	assert.Len(t, c.inputs, 1)
+	assert.Equal(t, "b", peekData(t, sp))
+	assert.Nil(t, sp.commit())
+	assert.Equal(t, "c", peekData(t, sp))
+
+	// The spooled records aren't failed.
+	assert.Nil(t, reported)
+	assert.Equal(t, int64(0), metrics.recordsFailed)
+	assert.Equal(t, int64(2), metrics.recordsSpooled)
+	assert.Equal(t, 0, f.pending())
+}
+
+func TestSpoolReplayer(t *testing.T) {
+	sp, cleanup := testSpool(t, &SpoolConfig{})
+	defer cleanup()
+
+	assert.Nil(t, sp.append(testInput("a", "b")))
+	assert.Nil(t, sp.append(testInput("c")))
+
+	c := &retryClient{
+		outputs: []*kinesis.PutRecordsOutput{
+			{
+				FailedRecordCount: aws.Int64(1),
+				Records: []*kinesis.PutRecordsResultEntry{
+					{SequenceNumber: aws.String("1")},
+					{ErrorCode: aws.String("ProvisionedThroughputExceededException")},
+				},
+			},
+			{FailedRecordCount: aws.Int64(0)},
+		},
+	}
+	r := newSpoolReplayer(sp, c, nil)
+	r.backoffFunc = noBackoff
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		r.run(quit)
+		close(done)
+	}()
+
+	for start := time.Now(); !sp.empty(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("Expected the spool to be replayed")
+		}
+	}
+	close(quit)
+	<-done
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	assert.Len(t, c.inputs, 3)
+	assert.Equal(t, "b", string(c.inputs[1].Records[0].Data))
+	assert.Equal(t, "c", string(c.inputs[2].Records[0].Data))
+}
+
+func TestStream_PendingOverflowSpooled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	tmpl, _ := template.New("").Parse("abc")
+	config := &Config{
+		PKeyTmpl:     tmpl,
+		PendingLimit: 2,
+		Spool:        &SpoolConfig{Dir: dir, Route: "route"},
+	}
+	s := NewStream(StreamSpec{Name: "abc"}, config)
+	assert.NotNil(t, s.spool)
+	assert.Equal(t, filepath.Join(dir, "route", "abc"), s.spool.dir)
+
+	for _, w := range []struct{ data, id string }{{"a", "123"}, {"b", "456"}, {"c", "123"}, {"d", "123"}} {
+		assert.Nil(t, s.Write(&router.Message{
+			Data:      w.data,
+			Container: &docker.Container{ID: w.id},
+		}))
+	}
+
+	// The queued messages are spooled with the one overflowing, in an
+	// input per container.
+	inp, err := s.spool.peek()
+	assert.Nil(t, err)
+	assert.Len(t, inp.Records, 2)
+	assert.Equal(t, "a", string(inp.Records[0].Data))
+	assert.Equal(t, "c", string(inp.Records[1].Data))
+	assert.Nil(t, s.spool.commit())
+	assert.Equal(t, "b", peekData(t, s.spool))
+	assert.Equal(t, int64(3), s.metrics.recordsSpooled)
+	assert.Equal(t, int64(0), s.metrics.pendingDropped)
+
+	messages, _ := s.pending.drain()
+	assert.Len(t, messages, 1)
+}
+
+func TestSpoolRoute(t *testing.T) {
+	assert.Equal(t, "abc", spoolRoute(&router.Route{ID: "abc"}))
+
+	// The routes without an ID are named after their settings.
+	route := &router.Route{Adapter: "kinesis", Address: "us-east-1", Options: map[string]string{"stream": "a"}}
+	assert.Len(t, spoolRoute(route), 12)
+	assert.Equal(t, spoolRoute(route), spoolRoute(&router.Route{Adapter: "kinesis", Address: "us-east-1", Options: map[string]string{"stream": "a"}}))
+	assert.NotEqual(t, spoolRoute(route), spoolRoute(&router.Route{Adapter: "kinesis", Address: "us-east-1", Options: map[string]string{"stream": "b"}}))
+}
+
+func TestFlusher_SpoolWriteError(t *testing.T) {
+	var reported []error
+	ErrorHandler = func(err error) {
+		if err != nil {
+			reported = append(reported, err)
+		}
+	}
+	defer func() { ErrorHandler = logErr }()
+
+	sp, cleanup := testSpool(t, &SpoolConfig{})
+	cleanup()
+
+	// The spool can't be written once its directory is removed.
+	metrics := newStreamMetrics()
+	f := &flusher{metrics: metrics, spool: sp, dropInputFunc: dropInput}
+	f.spoolInput(testInput("a", "b"))
+
+	assert.Len(t, reported, 1)
+	assert.IsType(t, &SpoolWriteError{}, reported[0])
+	assert.Equal(t, 2, reported[0].(*SpoolWriteError).Count)
+	assert.Equal(t, int64(2), metrics.recordsDropped)
+}
@@ -0,0 +1,192 @@
+package kinesis
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/gliderlabs/logspout/router"
+)
+
+func init() {
+	router.HttpHandlers.Register(statusHandler, "kinesis")
+}
+
+// streamStatus is the state of a stream served by the status API.
+type streamStatus struct {
+	Route        string             `json:"route"`
+	Stream       string             `json:"stream"`
+	Name         string             `json:"name"`
+	Ready        bool               `json:"ready"`
+	Backpressure BackpressurePolicy `json:"backpressure"`
+	Error        string             `json:"error,omitempty"`
+	Tags         map[string]string  `json:"tags,omitempty"`
+	Pending      int                `json:"pending"`
+	Spool        int64              `json:"spool_bytes,omitempty"`
+	Writers      []writerStatus     `json:"writers"`
+}
+
+// writerStatus is the state of the writer of a container.
+type writerStatus struct {
+	Container   string     `json:"container"`
+	Records     int        `json:"records"`
+	Bytes       int        `json:"bytes"`
+	RecordsFill float64    `json:"records_fill"`
+	BytesFill   float64    `json:"bytes_fill"`
+	LastWrite   time.Time  `json:"last_write"`
+	LastFlush   *time.Time `json:"last_flush,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// status returns a snapshot of the stream and its writers.
+func (s *Stream) status(route, key string) streamStatus {
+	s.statsMutex.RLock()
+	defer s.statsMutex.RUnlock()
+
+	st := streamStatus{
+		Route:        route,
+		Stream:       key,
+		Name:         s.name,
+		Ready:        s.ready,
+		Backpressure: s.backpressure,
+		Pending:      s.pending.len(),
+		Writers:      []writerStatus{},
+	}
+	if s.err != nil {
+		st.Error = s.err.Error()
+	}
+	if s.spool != nil {
+		st.Spool = s.spool.bytes()
+	}
+	if s.tags != nil && len(*s.tags) > 0 {
+		st.Tags = make(map[string]string, len(*s.tags))
+		for k, v := range *s.tags {
+			st.Tags[k] = aws.StringValue(v)
+		}
+	}
+
+	for id, w := range s.writers {
+		records, bytes := w.stats.get()
+		ws := writerStatus{
+			Container:   id,
+			Records:     records,
+			Bytes:       bytes,
+			RecordsFill: float64(records) / float64(w.buffer.limits.putRecords),
+			BytesFill:   float64(bytes) / float64(w.buffer.limits.putRecordsSize),
+			LastWrite:   w.stats.written(),
+		}
+		if lastFlush := w.flusher.lastFlush(); !lastFlush.IsZero() {
+			ws.LastFlush = &lastFlush
+		}
+		if err := w.flusher.lastError(); err != nil {
+			ws.LastError = err.Error()
+		}
+		st.Writers = append(st.Writers, ws)
+	}
+	sort.Slice(st.Writers, func(i, j int) bool {
+		return st.Writers[i].Container < st.Writers[j].Container
+	})
+
+	return st
+}
+
+// statusHandler serves the state of the streams of the adapters as JSON, and
+// the actions on them:
+//
+//	GET  /kinesis/streams
+//	POST /kinesis/flush?stream=<stream>[&route=<route>]
+//	POST /kinesis/reset?stream=<stream>[&route=<route>]
+func statusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/kinesis"), "/")
+
+		switch action {
+		case "", "streams":
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			writeJSON(w, http.StatusOK, streamStatuses(adapters.list()))
+		case "flush", "reset":
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			key := r.URL.Query().Get("stream")
+			matches := findStreams(adapters.list(), r.URL.Query().Get("route"), key)
+			if len(matches) == 0 {
+				http.Error(w, "stream not found: "+key, http.StatusNotFound)
+				return
+			}
+
+			if action == "flush" {
+				for _, s := range matches {
+					s.flush()
+				}
+				writeJSON(w, http.StatusAccepted, map[string]int{"flushed": len(matches)})
+				return
+			}
+
+			reset := 0
+			for _, s := range matches {
+				if s.reset() {
+					reset++
+				}
+			}
+			if reset == 0 {
+				http.Error(w, "stream hasn't failed: "+key, http.StatusConflict)
+				return
+			}
+			writeJSON(w, http.StatusAccepted, map[string]int{"reset": reset})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func streamStatuses(list []*Adapter) []streamStatus {
+	statuses := []streamStatus{}
+	for _, a := range list {
+		streams := a.streams()
+
+		keys := make([]string, 0, len(streams))
+		for key := range streams {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			statuses = append(statuses, streams[key].status(a.RouteID, key))
+		}
+	}
+
+	return statuses
+}
+
+// findStreams returns the streams of the key, in the route if set, else in
+// all the routes.
+func findStreams(list []*Adapter, route, key string) []*Stream {
+	var matches []*Stream
+	for _, a := range list {
+		if route != "" && a.RouteID != route {
+			continue
+		}
+		if s, ok := a.streams()[key]; ok {
+			matches = append(matches, s)
+		}
+	}
+
+	return matches
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		ErrorHandler(err)
+	}
+}
@@ -0,0 +1,116 @@
+package kinesis
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriter_RequestFlush(t *testing.T) {
+	tmpl, _ := template.New("").Parse("abc")
+	b := newBuffer(&Config{PKeyTmpl: tmpl}, "abc")
+	b.limits = &testLimits
+
+	f := &fakeFlusher{
+		inputs:  make(chan kinesis.PutRecordsInput, 10),
+		flushed: make(chan struct{}),
+	}
+
+	w := newWriter(b, f)
+	w.ticker = nil
+	go w.bufferMessages()
+
+	w.write(&router.Message{Data: "hello", Container: &docker.Container{ID: "123"}})
+
+	// The requests are ignored until the message is buffered.
+	timeout := time.After(1 * time.Second)
+	for flushed := false; !flushed; {
+		w.requestFlush()
+
+		select {
+		case <-f.flushed:
+			flushed = true
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("Expected flush to be called")
+		}
+	}
+
+	records, _ := w.stats.get()
+	assert.Equal(t, 0, records)
+}
+
+func TestStatusHandler(t *testing.T) {
+	tags := map[string]*string{"app": aws.String("abc")}
+	s := NewStream(StreamSpec{Name: "abc", Tags: &tags}, &Config{Client: &fakeClient{}})
+	s.err = errors.New("boom")
+
+	b := newBuffer(&Config{}, "abc")
+	b.limits = &testLimits
+	w := newWriter(b, &fakeFlusher{})
+	w.stats.set(1, 100)
+	s.writers["123"] = w
+
+	a := &Adapter{RouteID: "route1", Streams: map[string]*Stream{"abc": s}}
+	adapters.register(a)
+	defer adapters.unregister(a)
+
+	rec := httptest.NewRecorder()
+	statusHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/kinesis/streams", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var statuses []streamStatus
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &statuses))
+	assert.Len(t, statuses, 1)
+
+	st := statuses[0]
+	assert.Equal(t, "route1", st.Route)
+	assert.Equal(t, "abc", st.Stream)
+	assert.False(t, st.Ready)
+	assert.Equal(t, "boom", st.Error)
+	assert.Equal(t, "abc", st.Tags["app"])
+	assert.Len(t, st.Writers, 1)
+	assert.Equal(t, "123", st.Writers[0].Container)
+	assert.Equal(t, 1, st.Writers[0].Records)
+	assert.Equal(t, 0.5, st.Writers[0].RecordsFill)
+	assert.Nil(t, st.Writers[0].LastFlush)
+
+	rec = httptest.NewRecorder()
+	statusHandler().ServeHTTP(rec, httptest.NewRequest("POST", "/kinesis/streams", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestStatusHandler_Actions(t *testing.T) {
+	failed := NewStream(StreamSpec{Name: "failed"}, &Config{Client: &fakeClient{}})
+	failed.err = errors.New("boom")
+	ready := NewStream(StreamSpec{Name: "ready"}, &Config{Client: &fakeClient{}})
+	ready.ready = true
+
+	a := &Adapter{RouteID: "route1", Streams: map[string]*Stream{"failed": failed, "ready": ready}}
+	adapters.register(a)
+	defer adapters.unregister(a)
+
+	post := func(url string) int {
+		rec := httptest.NewRecorder()
+		statusHandler().ServeHTTP(rec, httptest.NewRequest("POST", url, nil))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusAccepted, post("/kinesis/reset?stream=failed"))
+	assert.Len(t, failed.retry, 1)
+
+	assert.Equal(t, http.StatusConflict, post("/kinesis/reset?stream=ready"))
+	assert.Equal(t, http.StatusNotFound, post("/kinesis/reset?stream=failed&route=route2"))
+	assert.Equal(t, http.StatusNotFound, post("/kinesis/flush?stream=unknown"))
+	assert.Equal(t, http.StatusAccepted, post("/kinesis/flush?stream=ready"))
+}
@@ -1,9 +1,13 @@
 package kinesis
 
 import (
+	"errors"
 	"fmt"
 	"log"
-	"text/template"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -12,7 +16,10 @@ import (
 	"github.com/gliderlabs/logspout/router"
 )
 
-// StreamNotReadyError is returned while the stream is being created.
+// StreamNotReadyError was returned while the stream was being created.
+//
+// Deprecated: the messages are now queued until the stream is ready, and
+// PendingOverflowError is returned when the queue is full.
 type StreamNotReadyError struct {
 	Stream string
 }
@@ -21,35 +28,232 @@ func (e *StreamNotReadyError) Error() string {
 	return fmt.Sprintf("not ready, stream: %s", e.Stream)
 }
 
+// errStreamStopped is returned when the stream is stopped while waiting for
+// its status.
+var errStreamStopped = errors.New("stream stopped")
+
+// LostRecordsError is returned when records couldn't be sent before the
+// shutdown timeout.
+type LostRecordsError struct {
+	Stream string
+	Count  int
+}
+
+func (e *LostRecordsError) Error() string {
+	return fmt.Sprintf("records lost on shutdown! stream: %s, # items: %d", e.Stream, e.Count)
+}
+
+const (
+	// DefaultReadyTimeout is the default maximum wait for a stream to become
+	// active.
+	DefaultReadyTimeout = 5 * time.Minute
+
+	// DefaultRetryInterval is the default wait before retrying to create and
+	// tag a stream that failed.
+	DefaultRetryInterval = time.Minute
+
+	statusBaseDelay = time.Second
+	statusMaxDelay  = 15 * time.Second
+)
+
+// StreamStatusError is returned when a stream is in a state it can't become
+// active from, e.g. DELETING.
+type StreamStatusError struct {
+	Stream string
+	Status string
+}
+
+func (e *StreamStatusError) Error() string {
+	return fmt.Sprintf("stream can't become active, stream: %s, status: %s", e.Stream, e.Status)
+}
+
+// InvalidShardCountError is returned when the shard count template doesn't
+// render a positive number.
+type InvalidShardCountError struct {
+	Stream string
+	Value  string
+}
+
+func (e *InvalidShardCountError) Error() string {
+	return fmt.Sprintf("invalid shard count, using the default. stream: %s, value: %q", e.Stream, e.Value)
+}
+
+// StreamKeyError is returned when a stream is encrypted with another KMS key
+// than the configured one while the encryption is required.
+type StreamKeyError struct {
+	Stream   string
+	KeyID    string
+	Expected string
+}
+
+func (e *StreamKeyError) Error() string {
+	return fmt.Sprintf("stream isn't encrypted with the KMS key, refusing to write. stream: %s, key: %s, expected: %s", e.Stream, e.KeyID, e.Expected)
+}
+
+// StreamTimeoutError is returned when a stream didn't become active before
+// the ready timeout.
+type StreamTimeoutError struct {
+	Stream string
+	Status string
+}
+
+func (e *StreamTimeoutError) Error() string {
+	return fmt.Sprintf("timed out waiting for stream: %s, status: %s", e.Stream, e.Status)
+}
+
+// StreamEncryptionError is returned when a stream isn't encrypted with KMS
+// while the encryption is required.
+type StreamEncryptionError struct {
+	Stream     string
+	Encryption string
+}
+
+func (e *StreamEncryptionError) Error() string {
+	return fmt.Sprintf("stream isn't encrypted with KMS, refusing to write. stream: %s, encryption: %s", e.Stream, e.Encryption)
+}
+
+// DefaultShardCount is the default number of shards of the streams created.
+const DefaultShardCount int64 = 1
+
+// StreamSpec describes a stream, as rendered from the message that triggered
+// its creation.
+type StreamSpec struct {
+	Name string
+	Tags *map[string]*string
+
+	// Key identifies the stream in the adapter, and names its spool
+	// directory. Empty uses the name.
+	Key string
+
+	// Shards is the number of shards to create the stream with. Zero uses
+	// the default.
+	Shards int64
+
+	// KMSKeyID is the KMS key the stream is encrypted with. Empty leaves
+	// the encryption of the stream unchanged.
+	KMSKeyID string
+
+	// Client is the client of the role the stream is managed and written
+	// with. Nil uses the client of the config.
+	Client Client
+
+	// Backpressure is the policy of the flushers when their queue is full.
+	// Empty uses the default.
+	Backpressure BackpressurePolicy
+}
+
 // Stream represents a stream that will send messages to its writer.
 type Stream struct {
-	client     Client
-	name       string
-	tags       *map[string]*string
-	writers    map[string]*writer
-	pKeyTmpl   *template.Template
-	ready      bool
-	readyWrite chan bool
-	err        error
-	errChan    chan error
+	client        Client
+	name          string
+	key           string
+	tags          *map[string]*string
+	shards        int64
+	kmsKeyID      string
+	backpressure  BackpressurePolicy
+	debug         debugLogger
+	config        *Config
+	readyTimeout  time.Duration
+	retryInterval time.Duration
+	backoffFunc   func(attempt int) time.Duration
+	quit          chan struct{}
+	retry         chan struct{}
+	mutex         sync.Mutex
+	writers       map[string]*writer
+	retired       []*writer
+	pending       *pendingQueue
+	spillMutex    sync.Mutex
+	ready         bool
+	err           error
+
+	// refused is the number of messages written after the stream was
+	// stopped, dropped rather than given to a new writer.
+	refused int
+
+	// statsMutex guards the writers, ready and err along with the lock of
+	// the stream, so the status API and the metrics read them without
+	// waiting for the writes.
+	statsMutex sync.RWMutex
+
+	// drained is closed when the pending queue is drained, waking up the
+	// messages blocked by the block policy.
+	drained chan struct{}
+
+	// dimensionMetrics are the metrics of the containers by their CloudWatch
+	// dimensions, guarded by statsMutex.
+	dimensionMetrics map[string]*dimensionMetrics
+
+	// created is set when the stream was created by the adapter, rather
+	// than already existing, and is then tagged even with SkipRetag.
+	created bool
+
+	// managed is set when the stream was created by the adapter, now or
+	// before a restart as told by its managed tag. Only the managed streams
+	// are resharded.
+	managed   bool
+	resharder *resharder
+	metrics   *streamMetrics
+	spool     *spool
+
+	// templateError handles the messages whose templates couldn't be
+	// rendered by the writers.
+	templateError func(m *router.Message, err error)
 }
 
 // NewStream instantiates a new stream.
-func NewStream(name string, tags *map[string]*string, pKeyTmpl *template.Template) *Stream {
-	session := session.New(&aws.Config{})
-	client := &client{
-		kinesis: kinesis.New(session),
+func NewStream(spec StreamSpec, config *Config) *Stream {
+	if config == nil {
+		config = &Config{}
+	}
+
+	client := spec.Client
+	if client == nil {
+		client = config.Client
+	}
+	if client == nil {
+		client = NewClient(session.New(&aws.Config{}), config.Firehose)
 	}
 
 	s := &Stream{
-		client:     client,
-		name:       name,
-		tags:       tags,
-		writers:    make(map[string]*writer),
-		pKeyTmpl:   pKeyTmpl,
-		readyWrite: make(chan bool),
-		errChan:    make(chan error),
+		client:        client,
+		name:          spec.Name,
+		key:           spec.Key,
+		tags:          spec.Tags,
+		shards:        spec.Shards,
+		kmsKeyID:      spec.KMSKeyID,
+		backpressure:  spec.Backpressure,
+		debug:         debugLogger(config.Debug),
+		config:        config,
+		readyTimeout:  DefaultReadyTimeout,
+		retryInterval: DefaultRetryInterval,
+		backoffFunc:   statusBackoff,
+		quit:          make(chan struct{}),
+		retry:         make(chan struct{}, 1),
+		writers:       make(map[string]*writer),
+		pending:       newPendingQueue(config.PendingLimit, config.PendingSizeLimit),
+		drained:       make(chan struct{}),
+		metrics:       newStreamMetrics(),
+		templateError: reportTemplateError,
+
+		dimensionMetrics: make(map[string]*dimensionMetrics),
+	}
+
+	if s.key == "" {
+		s.key = s.name
 	}
+	if s.backpressure == "" {
+		s.backpressure = defaultBackpressure(config)
+	}
+	if s.shards <= 0 {
+		s.shards = DefaultShardCount
+	}
+	if config.ReadyTimeout > 0 {
+		s.readyTimeout = config.ReadyTimeout
+	}
+	if config.RetryInterval > 0 {
+		s.retryInterval = config.RetryInterval
+	}
+	s.openSpool()
 
 	return s
 }
@@ -60,94 +264,729 @@ func (s *Stream) Start() {
 	go s.start()
 }
 
+// start creates and tags the stream, retrying after the retry interval
+// until it succeeds or the stream is stopped.
 func (s *Stream) start() {
-	if err := s.create(); err != nil {
-		s.errChan <- err
+	for {
+		err := s.setup()
+		if err == nil {
+			s.becomeReady()
+			return
+		}
+		if err == errStreamStopped {
+			return
+		}
+
+		s.mutex.Lock()
+		s.statsMutex.Lock()
+		s.err = err
+		s.statsMutex.Unlock()
+		s.mutex.Unlock()
 		ErrorHandler(err)
+
+		select {
+		case <-time.After(s.retryInterval):
+			s.debug.printf("retrying, stream: %s", s.name)
+		case <-s.retry:
+			s.debug.printf("retrying on reset, stream: %s", s.name)
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *Stream) setup() error {
+	if s.config.SkipCreate {
+		// The stream is managed elsewhere, we only check it's ready.
+		if err := s.waitActive(); err != nil {
+			return err
+		}
+	} else if err := s.create(); err != nil {
+		return err
+	}
+
+	if err := s.encrypt(); err != nil {
+		return err
+	}
+
+	if s.reshardable() {
+		if err := s.manage(); err != nil {
+			return err
+		}
+	}
+
+	if s.config.SkipTag || (s.config.SkipRetag && !s.created) {
+		return nil
+	}
+
+	return s.tag()
+}
+
+func (s *Stream) becomeReady() {
+	s.mutex.Lock()
+
+	// The stream was stopped in the meantime.
+	select {
+	case <-s.quit:
+		s.mutex.Unlock()
+		return
+	default:
+	}
+
+	s.statsMutex.Lock()
+	s.err = nil
+	s.statsMutex.Unlock()
+	s.startResharder()
+	s.startSpool()
+	s.mutex.Unlock()
+
+	if s.replay() {
+		log.Printf("ready! stream: %s", s.name)
+	}
+}
+
+// startResharder starts measuring the throughput of the stream, if it's
+// managed by the adapter and resharding is enabled.
+func (s *Stream) startResharder() {
+	if !s.managed {
 		return
 	}
 
-	if err := s.tag(); err != nil {
-		s.errChan <- err
+	s.resharder = newResharder(s.client, s.name, s.shards, s.config.Reshard)
+	s.resharder.debug = s.debug
+	go s.resharder.run(s.quit)
+}
+
+func (s *Stream) reshardable() bool {
+	return !s.config.SkipCreate && s.config.Reshard != nil && !s.config.OnDemand && s.config.Firehose == nil
+}
+
+// manage tags the stream created by the adapter as managed, or tells from
+// its managed tag if the stream that already existed was created by the
+// adapter before a restart. The tag is left out with SkipTag, the stream
+// then being resharded until the next restart only.
+func (s *Stream) manage() error {
+	if s.created {
+		s.managed = true
+		if s.config.SkipTag {
+			return nil
+		}
+
+		return s.client.Tag(&kinesis.AddTagsToStreamInput{
+			StreamName: aws.String(s.name),
+			Tags:       map[string]*string{ManagedTagKey: aws.String("true")},
+		})
+	}
+
+	tags, err := s.client.Tags(&kinesis.ListTagsForStreamInput{
+		StreamName: aws.String(s.name),
+	})
+	if err != nil {
+		ErrorHandler(err)
+		return nil
+	}
+	if tags[ManagedTagKey] != "true" {
+		s.debug.printf("stream not created by the adapter, not resharding. stream: %s", s.name)
+		return nil
+	}
+
+	s.managed = s.readShards()
+	return nil
+}
+
+// readShards reads the shard count of a managed stream that already existed,
+// which may have been resharded before a restart. The count of the spec is
+// kept if it can't be read. It returns false if the stream has no open
+// shards, and can't be resharded.
+func (s *Stream) readShards() bool {
+	shards, err := s.client.Shards(&kinesis.DescribeStreamSummaryInput{
+		StreamName: aws.String(s.name),
+	})
+	if err != nil {
 		ErrorHandler(err)
+		return true
+	}
+	if shards <= 0 {
+		s.debug.printf("stream without open shards, not resharding. stream: %s", s.name)
+		return false
+	}
+
+	s.shards = shards
+	return true
+}
+
+// openSpool opens the spool of a stream spilling its inputs, so the messages
+// overflowing the pending queue are spooled until the stream is ready. A
+// spool that can't be opened is reported, and the inputs are dropped instead.
+func (s *Stream) openSpool() {
+	if s.config.Spool == nil || s.backpressure != Spill {
+		return
+	}
+
+	dir := filepath.Join(s.config.Spool.Dir, url.PathEscape(s.config.Spool.Route), url.PathEscape(s.key))
+	sp, err := openSpool(s.name, dir, s.config.Spool)
+	if err != nil {
+		ErrorHandler(&SpoolError{Stream: s.name, Err: err})
 		return
 	}
 
-	s.readyWrite <- true
-	log.Printf("ready! stream: %s", s.name)
+	s.spool = sp
+}
+
+// startSpool replays the inputs spooled before the stream was ready or
+// before a restart.
+func (s *Stream) startSpool() {
+	if s.spool == nil {
+		return
+	}
+
+	r := newSpoolReplayer(s.spool, s.writeClient(), s.metrics)
+	r.debug = s.debug
+	go r.run(s.quit)
+}
+
+// writeClient returns the client the records are sent with, measuring the
+// throughput of the stream if it's resharded.
+func (s *Stream) writeClient() Client {
+	if s.resharder != nil {
+		return &reshardClient{Client: s.client, resharder: s.resharder}
+	}
+
+	return s.client
+}
+
+// replay writes the messages queued while the stream wasn't ready, and
+// marks it ready once the queue is empty. The messages are written without
+// holding the lock, the new ones being queued meanwhile to keep their order.
+// It returns false if the stream was stopped in the meantime.
+func (s *Stream) replay() bool {
+	replayed := 0
+	for {
+		s.mutex.Lock()
+		select {
+		case <-s.quit:
+			s.mutex.Unlock()
+			return false
+		default:
+		}
+
+		// The messages being spilled are spooled before the ones replayed.
+		s.spillMutex.Lock()
+		s.spillMutex.Unlock()
+
+		messages, dropped := s.pending.drain()
+		close(s.drained)
+		s.drained = make(chan struct{})
+
+		if len(messages) == 0 && dropped == 0 {
+			s.statsMutex.Lock()
+			s.ready = true
+			s.statsMutex.Unlock()
+			s.mutex.Unlock()
+			s.debug.printf("pending messages replayed, stream: %s, # items: %d", s.name, replayed)
+			return true
+		}
+		s.mutex.Unlock()
+
+		if dropped > 0 {
+			ErrorHandler(&PendingOverflowError{Stream: s.name, Count: dropped})
+		}
+
+		for _, pm := range messages {
+			s.write(pm.message, pm.overrides)
+		}
+		replayed += len(messages)
+	}
 }
 
 // Write sends the message to the writer if the stream is ready
-// i.e created and tagged.
+// i.e created and tagged, or queues it until then. The overrides of the
+// container labels are resolved from the message.
 func (s *Stream) Write(m *router.Message) error {
-	select {
-	case s.ready = <-s.readyWrite:
-	case s.err = <-s.errChan:
-	default:
+	return s.writeOverridden(m, nil)
+}
+
+// writeOverridden writes the message with the overrides of its container,
+// already resolved by the adapter, or resolved from the message if nil.
+func (s *Stream) writeOverridden(m *router.Message, o *overrides) error {
+	var timeout <-chan time.Time
+	expired := false
+
+	for {
+		s.mutex.Lock()
+		if s.ready {
+			s.mutex.Unlock()
+			s.write(m, o)
+			return nil
+		}
+		if s.pending.fits(m) {
+			s.pending.push(m, o)
+			s.mutex.Unlock()
+			return nil
+		}
+		if s.backpressure != Block || expired {
+			return s.overflow(m, o)
+		}
+
+		// The block policy waits for the queue to be drained once the
+		// stream is ready, without holding the lock.
+		if timeout == nil {
+			blockTimeout := s.config.BlockTimeout
+			if blockTimeout <= 0 {
+				blockTimeout = DefaultBlockTimeout
+			}
+			timer := time.NewTimer(blockTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		drained := s.drained
+		s.mutex.Unlock()
+
+		select {
+		case <-drained:
+		case <-timeout:
+			expired = true
+		case <-s.quit:
+			expired = true
+		}
 	}
+}
 
-	switch {
-	case s.err != nil:
-		return s.err
-	case s.ready:
-		return s.write(m)
-	default:
-		return &StreamNotReadyError{Stream: s.name}
+// overflow applies the backpressure policy to the message that doesn't fit
+// in the pending queue. It's called with the lock held, and releases it.
+func (s *Stream) overflow(m *router.Message, o *overrides) error {
+	// The queued messages are spooled before the new one to keep their
+	// order, the ones queued next follow them once replayed.
+	if s.spool != nil {
+		messages, dropped := s.pending.drain()
+		s.spillMutex.Lock()
+		defer s.spillMutex.Unlock()
+		s.mutex.Unlock()
+
+		s.spill(append(messages, pendingMessage{message: m, overrides: o}))
+		if dropped > 0 {
+			return &PendingOverflowError{Stream: s.name, Count: dropped}
+		}
+		return nil
+	}
+	defer s.mutex.Unlock()
+
+	reported := s.pending.reported
+	if s.backpressure == DropOldest {
+		for !s.pending.fits(m) && s.pending.shift() {
+			s.metrics.droppedPending()
+		}
+	}
+	if !s.pending.push(m, o) {
+		s.metrics.droppedPending()
+	}
+
+	// We only report the first messages dropped, the others are reported
+	// once the stream is ready.
+	if reported == 0 && s.pending.dropped > 0 {
+		return &PendingOverflowError{Stream: s.name, Count: s.pending.report()}
+	}
+	return nil
+}
+
+// spill writes the messages to the spool, buffered by container into full
+// inputs, so each input is appended once.
+func (s *Stream) spill(messages []pendingMessage) {
+	buffers := make(map[string]*buffer)
+	var containers []string
+
+	for _, pm := range messages {
+		id := pm.message.Container.ID
+		b, ok := buffers[id]
+		if !ok {
+			o := pm.overrides
+			if o == nil {
+				var err error
+				o, err = newOverrides(pm.message.Container, s.config)
+				ErrorHandler(err)
+			}
+			b = newBuffer(s.config, s.name)
+			b.metrics = s.metrics
+			b.override(o)
+
+			buffers[id] = b
+			containers = append(containers, id)
+		}
+
+		e, err := b.entry(pm.message)
+		if te, ok := err.(*TemplateError); ok {
+			s.templateError(pm.message, te.Err)
+			continue
+		}
+		if err != nil {
+			if err == ErrRecordTooBig {
+				s.metrics.tooBig()
+			}
+			ErrorHandler(err)
+			continue
+		}
+
+		if b.full(e) {
+			s.spoolBuffer(b)
+		}
+		b.add(e)
+	}
+
+	for _, id := range containers {
+		s.spoolBuffer(buffers[id])
+	}
+
+	s.debug.printf("pending queue full, spooled. stream: %s, # items: %d", s.name, len(messages))
+}
+
+// spoolBuffer writes the buffered records to the spool, and resets the
+// buffer.
+func (s *Stream) spoolBuffer(b *buffer) {
+	b.seal()
+	if len(b.input.Records) > 0 {
+		spoolInput(s.spool, s.metrics, b.input)
+	}
+	b.reset()
+}
+
+// write sends the message to the writer of its container without holding the
+// lock, since the writer may be busy. A writer evicted in the meantime is
+// replaced, unless the stream was stopped: the message is then dropped.
+func (s *Stream) write(m *router.Message, o *overrides) {
+	for {
+		s.mutex.Lock()
+		select {
+		case <-s.quit:
+			s.refused++
+			s.mutex.Unlock()
+			s.metrics.dropped(1)
+			return
+		default:
+		}
+		w := s.writer(m, o)
+		s.mutex.Unlock()
+
+		if w.write(m) {
+			return
+		}
 	}
 }
 
-func (s *Stream) write(m *router.Message) error {
+// writer returns the writer of the container of the message, starting it if
+// needed.
+func (s *Stream) writer(m *router.Message, o *overrides) *writer {
 	if w, ok := s.writers[m.Container.ID]; ok {
-		w.write(m)
-		return nil
+		w.stats.wrote(time.Now())
+		return w
 	}
 
-	w := newWriter(
-		newBuffer(s.pKeyTmpl, s.name),
-		newFlusher(s.client),
-	)
+	if o == nil {
+		var err error
+		o, err = newOverrides(m.Container, s.config)
+		ErrorHandler(err)
+	}
+	metrics := s.containerMetrics(m)
+	b := newBuffer(s.config, s.name)
+	b.metrics = metrics
+	b.override(o)
+
+	w := newWriter(b, newFlusher(s.writeClient(), flusherConfig{
+		retryLimit:   s.config.RetryLimit,
+		queueDepth:   s.config.QueueDepth,
+		policy:       s.backpressure,
+		blockTimeout: s.config.BlockTimeout,
+		metrics:      metrics,
+		spool:        s.spool,
+		debug:        s.debug,
+	}))
+	w.metrics = metrics
+	w.templateError = s.templateError
 	w.start()
+	s.statsMutex.Lock()
 	s.writers[m.Container.ID] = w
-	w.write(m)
-	return nil
+	s.statsMutex.Unlock()
+	return w
+}
+
+// streamState is a snapshot of the state of a stream.
+type streamState struct {
+	ready   bool
+	writers int
+	queued  int
+	metrics *streamMetrics
+}
+
+func (s *Stream) state() streamState {
+	s.statsMutex.RLock()
+	defer s.statsMutex.RUnlock()
+
+	state := streamState{
+		ready:   s.ready,
+		writers: len(s.writers),
+		metrics: s.metrics,
+	}
+	for _, w := range s.writers {
+		state.queued += w.flusher.queued()
+	}
+
+	return state
+}
+
+// reset retries to create and tag a failed stream without waiting for the
+// retry interval. It returns false if the stream hasn't failed.
+func (s *Stream) reset() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.ready || s.err == nil {
+		return false
+	}
+
+	select {
+	case s.retry <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// flush asks the writers to flush their buffers.
+func (s *Stream) flush() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, w := range s.writers {
+		w.requestFlush()
+	}
+}
+
+// evict stops the writer of the container, flushing its buffer.
+func (s *Stream) evict(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.evictWriter(id)
+	s.pruneRetired()
+}
+
+func (s *Stream) evictWriter(id string) {
+	w, ok := s.writers[id]
+	if !ok {
+		return
+	}
+
+	s.statsMutex.Lock()
+	delete(s.writers, id)
+	s.statsMutex.Unlock()
+	w.stop()
+	s.retired = append(s.retired, w)
+
+	s.debug.printf("writer evicted, stream: %s, container: %s", s.name, id)
+}
+
+// evictIdle evicts the writers that haven't written for the idle timeout,
+// and forgets the evicted writers that sent all their records.
+func (s *Stream) evictIdle(idle time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for id, w := range s.writers {
+		if time.Since(w.stats.written()) > idle {
+			s.evictWriter(id)
+		}
+	}
+
+	s.pruneRetired()
+}
+
+// pruneRetired forgets the evicted writers that sent all their records.
+func (s *Stream) pruneRetired() {
+	retired := s.retired[:0]
+	for _, w := range s.retired {
+		select {
+		case <-w.flusher.done():
+		default:
+			retired = append(retired, w)
+		}
+	}
+	s.retired = retired
+}
+
+// stop stops the writers, flushing their buffers, and the stream creation
+// retries.
+func (s *Stream) stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	close(s.quit)
+
+	for id := range s.writers {
+		s.evictWriter(id)
+	}
+}
+
+// wait waits for the stopped writers to send their records until timeout is
+// closed, and returns the number of records that weren't sent, including
+// the messages still pending and the ones written after the stop.
+func (s *Stream) wait(timeout <-chan struct{}) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	lost := s.pending.len() + s.refused
+	for _, w := range s.retired {
+		select {
+		case <-w.flusher.done():
+		case <-timeout:
+		}
+
+		lost += w.flusher.pending()
+	}
+
+	return lost
 }
 
 func (s *Stream) create() error {
-	created, err := s.client.Create(&kinesis.CreateStreamInput{
-		ShardCount: aws.Int64(1),
+	input := &kinesis.CreateStreamInput{
+		ShardCount: aws.Int64(s.shards),
 		StreamName: aws.String(s.name),
-	})
+	}
+	if s.config.OnDemand {
+		input.ShardCount = nil
+		input.StreamModeDetails = &kinesis.StreamModeDetails{
+			StreamMode: aws.String(kinesis.StreamModeOnDemand),
+		}
+	}
+
+	exists, err := s.client.Create(input)
 
 	if err != nil {
 		return err
 	}
 
-	if created {
-		return nil
+	if !exists {
+		s.debug.printf("need to create stream: %s", s.name)
+		s.created = true
 	}
 
-	debug("need to create stream: %s", s.name)
-	for {
-		status := s.client.Status(&kinesis.DescribeStreamInput{
+	return s.waitActive()
+}
+
+// waitActive polls the stream status, with backoff, until the stream is
+// active or the ready timeout is reached. An updating stream is active.
+func (s *Stream) waitActive() error {
+	return s.waitStatus(kinesis.StreamStatusActive, kinesis.StreamStatusUpdating)
+}
+
+// waitStatus polls the stream status, with backoff, until it's one of the
+// statuses or the ready timeout is reached.
+func (s *Stream) waitStatus(statuses ...string) error {
+	deadline := time.Now().Add(s.readyTimeout)
+
+	for attempt := 1; ; attempt++ {
+		status, err := s.client.Status(&kinesis.DescribeStreamInput{
 			StreamName: aws.String(s.name),
 		})
-		if status == "ACTIVE" {
-			return nil
+		if err != nil {
+			return err
+		}
+
+		for _, st := range statuses {
+			if status == st {
+				return nil
+			}
+		}
+
+		// e.g. Firehose CREATING_FAILED.
+		if status == kinesis.StreamStatusDeleting || strings.HasSuffix(status, "_FAILED") {
+			return &StreamStatusError{Stream: s.name, Status: status}
+		}
+
+		s.debug.printf("stream %s status: %s", s.name, status)
+
+		if time.Now().After(deadline) {
+			return &StreamTimeoutError{Stream: s.name, Status: status}
+		}
+
+		select {
+		case <-time.After(s.backoffFunc(attempt)):
+		case <-s.quit:
+			return errStreamStopped
 		}
-		time.Sleep(4 * time.Second) // wait a bit
-		debug("stream %s status: %s", s.name, status)
 	}
 }
 
-func (s *Stream) tag() error {
-	err := s.client.Tag(&kinesis.AddTagsToStreamInput{
+// statusBackoff returns the delay before polling the stream status again.
+func statusBackoff(attempt int) time.Duration {
+	return jitteredBackoff(statusBaseDelay, statusMaxDelay, attempt)
+}
+
+// encrypt starts the encryption of the streams it manages with the KMS key,
+// and checks the stream is encrypted if required.
+func (s *Stream) encrypt() error {
+	if s.kmsKeyID == "" && !s.config.RequireEncryption {
+		return nil
+	}
+
+	encryption, keyID, err := s.client.Encryption(&kinesis.DescribeStreamInput{
 		StreamName: aws.String(s.name),
-		Tags:       *s.tags,
 	})
-
 	if err != nil {
 		return err
 	}
 
+	if s.kmsKeyID != "" && !s.config.SkipCreate && encryption != kinesis.EncryptionTypeKms {
+		err = s.client.Encrypt(&kinesis.StartStreamEncryptionInput{
+			StreamName:     aws.String(s.name),
+			EncryptionType: aws.String(kinesis.EncryptionTypeKms),
+			KeyId:          aws.String(s.kmsKeyID),
+		})
+		if err != nil {
+			return err
+		}
+
+		s.debug.printf("encrypting stream: %s, key: %s", s.name, s.kmsKeyID)
+
+		// The stream is updating while being encrypted.
+		if err := s.waitStatus(kinesis.StreamStatusActive); err != nil {
+			return err
+		}
+		encryption, keyID = kinesis.EncryptionTypeKms, s.kmsKeyID
+	}
+
+	if s.config.RequireEncryption && encryption != kinesis.EncryptionTypeKms {
+		return &StreamEncryptionError{Stream: s.name, Encryption: encryption}
+	}
+	if s.config.RequireEncryption && s.kmsKeyID != "" && !sameKMSKey(keyID, s.kmsKeyID) {
+		return &StreamKeyError{Stream: s.name, KeyID: keyID, Expected: s.kmsKeyID}
+	}
+
+	return nil
+}
+
+// sameKMSKey tells if the key IDs are the same, one of them being possibly
+// the ARN of the other, e.g. the ARN of an alias and the alias. The aliases
+// aren't resolved.
+func sameKMSKey(a, b string) bool {
+	arnOf := func(arn, id string) bool {
+		return strings.HasSuffix(arn, ":"+id) || strings.HasSuffix(arn, ":key/"+id)
+	}
+
+	return a == b || arnOf(a, b) || arnOf(b, a)
+}
+
+func (s *Stream) tag() error {
+	if s.tags == nil {
+		return nil
+	}
+
+	for _, tags := range tagBatches(*s.tags) {
+		err := s.client.Tag(&kinesis.AddTagsToStreamInput{
+			StreamName: aws.String(s.name),
+			Tags:       tags,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
@@ -15,30 +15,82 @@ import (
 )
 
 type fakeClient struct {
-	created bool
-	status  string
-	err     error
-	mutex   sync.Mutex
+	created    bool
+	status     string
+	statusErr  error
+	err        error
+	createCall bool
+	tagCall    bool
+	tagged     map[string]*string
+	tags       map[string]string
+	input      *kinesis.CreateStreamInput
+	reshards   []int64
+	shardCount int64
+	encryption string
+	keyID      string
+	encrypted  string
+	mutex      sync.Mutex
 }
 
 func (f *fakeClient) Create(input *kinesis.CreateStreamInput) (bool, error) {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 
+	f.createCall = true
+	f.input = input
 	return f.created, f.err
 }
 
-func (f *fakeClient) Status(input *kinesis.DescribeStreamInput) string {
+func (f *fakeClient) Status(input *kinesis.DescribeStreamInput) (string, error) {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 
-	return f.status
+	return f.status, f.statusErr
 }
 
 func (f *fakeClient) Tag(input *kinesis.AddTagsToStreamInput) error {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 
+	f.tagCall = true
+	f.tagged = input.Tags
+	return f.err
+}
+
+func (f *fakeClient) Tags(input *kinesis.ListTagsForStreamInput) (map[string]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.tags, f.statusErr
+}
+
+func (f *fakeClient) Reshard(input *kinesis.UpdateShardCountInput) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.reshards = append(f.reshards, aws.Int64Value(input.TargetShardCount))
+	return f.err
+}
+
+func (f *fakeClient) Shards(input *kinesis.DescribeStreamSummaryInput) (int64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.shardCount, f.statusErr
+}
+
+func (f *fakeClient) Encryption(input *kinesis.DescribeStreamInput) (string, string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.encryption, f.keyID, f.statusErr
+}
+
+func (f *fakeClient) Encrypt(input *kinesis.StartStreamEncryptionInput) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.encrypted = aws.StringValue(input.KeyId)
 	return f.err
 }
 
@@ -46,20 +98,50 @@ func (f *fakeClient) PutRecords(inp *kinesis.PutRecordsInput) (*kinesis.PutRecor
 	return nil, nil
 }
 
-// TODO: implement optional stream creation
-// func TestStream_CreationDeactivated(t *testing.T) {
+func TestStream_CreationDeactivated(t *testing.T) {
+	tags := map[string]*string{"app": aws.String("abc")}
 
-// }
+	s := NewStream(StreamSpec{Name: "abc", Tags: &tags}, &Config{SkipCreate: true})
+	fk := &fakeClient{
+		status: "ACTIVE",
+	}
+	s.client = fk
+
+	err := s.setup()
+	assert.Nil(t, err)
+	assert.False(t, fk.createCall, "The stream shouldn't be created")
+	assert.True(t, fk.tagCall, "The stream should be tagged")
+}
+
+func TestStream_CreationDeactivatedNotActive(t *testing.T) {
+	s := NewStream(StreamSpec{Name: "abc"}, &Config{SkipCreate: true, SkipTag: true})
+	s.client = &fakeClient{
+		status: "DELETING",
+	}
 
-// TODO: implement optional stream tagging
-// func TestStream_TaggingDeactivated(t *testing.T) {
+	err := s.setup()
+	assert.Equal(t, &StreamStatusError{Stream: "abc", Status: "DELETING"}, err)
+}
 
-// }
+func TestStream_TaggingDeactivated(t *testing.T) {
+	s := NewStream(StreamSpec{Name: "abc"}, &Config{SkipTag: true})
+	fk := &fakeClient{
+		created: true,
+		status:  "ACTIVE",
+	}
+	s.client = fk
+
+	err := s.setup()
+	assert.Nil(t, err)
+	assert.True(t, fk.createCall, "The stream should be created")
+	assert.False(t, fk.tagCall, "The stream shouldn't be tagged")
+}
 
 func TestStream_CreateAlreadyExists(t *testing.T) {
-	s := NewStream("abc", nil, nil)
+	s := NewStream(StreamSpec{Name: "abc"}, nil)
 	s.client = &fakeClient{
 		created: true,
+		status:  "ACTIVE",
 	}
 
 	err := s.create()
@@ -67,7 +149,7 @@ func TestStream_CreateAlreadyExists(t *testing.T) {
 }
 
 func TestStream_CreateStatusActive(t *testing.T) {
-	s := NewStream("abc", nil, nil)
+	s := NewStream(StreamSpec{Name: "abc"}, nil)
 	s.client = &fakeClient{
 		created: false,
 		status:  "ACTIVE",
@@ -77,8 +159,62 @@ func TestStream_CreateStatusActive(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestStream_CreateShardCount(t *testing.T) {
+	s := NewStream(StreamSpec{Name: "abc", Shards: 4}, nil)
+	client := &fakeClient{status: "ACTIVE"}
+	s.client = client
+
+	err := s.create()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), aws.Int64Value(client.input.ShardCount))
+	assert.Nil(t, client.input.StreamModeDetails)
+}
+
+func TestStream_CreateDefaultShardCount(t *testing.T) {
+	s := NewStream(StreamSpec{Name: "abc"}, nil)
+	client := &fakeClient{status: "ACTIVE"}
+	s.client = client
+
+	err := s.create()
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultShardCount, aws.Int64Value(client.input.ShardCount))
+}
+
+func TestStream_CreateOnDemand(t *testing.T) {
+	s := NewStream(StreamSpec{Name: "abc", Shards: 4}, &Config{OnDemand: true})
+	client := &fakeClient{status: "ACTIVE"}
+	s.client = client
+
+	err := s.create()
+	assert.Nil(t, err)
+	assert.Nil(t, client.input.ShardCount)
+	assert.Equal(t, kinesis.StreamModeOnDemand, aws.StringValue(client.input.StreamModeDetails.StreamMode))
+}
+
+func TestStreamShards(t *testing.T) {
+	tmpl, _ := parseTmpl(`{{ index .Container.Config.Labels "kinesis.shards" }}`)
+
+	var reported error
+	ErrorHandler = func(err error) { reported = err }
+	defer func() { ErrorHandler = logErr }()
+
+	m := &router.Message{Container: &docker.Container{Config: &docker.Config{Labels: map[string]string{"kinesis.shards": "8"}}}}
+	assert.Equal(t, int64(8), streamShards(tmpl, "abc", m))
+	assert.Nil(t, reported)
+
+	m.Container.Config.Labels["kinesis.shards"] = ""
+	assert.Equal(t, int64(0), streamShards(tmpl, "abc", m))
+	assert.Nil(t, reported)
+
+	m.Container.Config.Labels["kinesis.shards"] = "many"
+	assert.Equal(t, int64(0), streamShards(tmpl, "abc", m))
+	assert.IsType(t, &InvalidShardCountError{}, reported)
+
+	assert.Equal(t, int64(0), streamShards(nil, "abc", m))
+}
+
 func TestStream_CreateError(t *testing.T) {
-	s := NewStream("abc", nil, nil)
+	s := NewStream(StreamSpec{Name: "abc"}, nil)
 	s.client = &fakeClient{
 		created: false,
 		err:     awserr.New("RequestError", "500", nil),
@@ -88,6 +224,111 @@ func TestStream_CreateError(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
+func TestStream_CreateStatusDeleting(t *testing.T) {
+	s := NewStream(StreamSpec{Name: "abc"}, nil)
+	s.client = &fakeClient{
+		created: true,
+		status:  "DELETING",
+	}
+
+	err := s.create()
+	assert.Equal(t, &StreamStatusError{Stream: "abc", Status: "DELETING"}, err)
+}
+
+func TestStream_CreateStatusError(t *testing.T) {
+	statusErr := &DescribeStreamError{
+		Stream: "abc",
+		Err:    awserr.New("AccessDeniedException", "denied", nil),
+	}
+
+	s := NewStream(StreamSpec{Name: "abc"}, nil)
+	s.client = &fakeClient{
+		created:   false,
+		statusErr: statusErr,
+	}
+
+	err := s.create()
+	assert.Equal(t, statusErr, err)
+}
+
+func TestStream_CreateTimeout(t *testing.T) {
+	s := NewStream(StreamSpec{Name: "abc"}, &Config{ReadyTimeout: time.Millisecond})
+	s.backoffFunc = func(attempt int) time.Duration {
+		return time.Millisecond
+	}
+	s.client = &fakeClient{
+		created: false,
+		status:  "CREATING",
+	}
+
+	err := s.create()
+	assert.Equal(t, &StreamTimeoutError{Stream: "abc", Status: "CREATING"}, err)
+}
+
+func TestStream_CreateStopped(t *testing.T) {
+	s := NewStream(StreamSpec{Name: "abc"}, nil)
+	s.backoffFunc = func(attempt int) time.Duration {
+		return time.Hour
+	}
+	s.client = &fakeClient{
+		created: false,
+		status:  "CREATING",
+	}
+
+	errs := make(chan error)
+	go func() { errs <- s.create() }()
+	s.stop()
+
+	select {
+	case err := <-errs:
+		assert.Equal(t, errStreamStopped, err)
+	case <-time.After(time.Second):
+		t.Fatal("Expected the stop to interrupt the wait")
+	}
+}
+
+func TestStream_RetryAfterFailure(t *testing.T) {
+	tags := map[string]*string{"app": aws.String("abc")}
+
+	s := NewStream(StreamSpec{Name: "abc", Tags: &tags}, &Config{RetryInterval: time.Millisecond})
+	fk := &fakeClient{
+		created: false,
+		err:     awserr.New("LimitExceededException", "slow down", nil),
+	}
+	s.client = fk
+	s.Start()
+	defer s.stop()
+
+	time.Sleep(10 * time.Millisecond)
+	s.mutex.Lock()
+	assert.False(t, s.ready)
+	assert.NotNil(t, s.err)
+	s.mutex.Unlock()
+
+	fk.mutex.Lock()
+	fk.err = nil
+	fk.status = "ACTIVE"
+	fk.mutex.Unlock()
+
+	timeout := time.After(time.Second)
+	for {
+		s.mutex.Lock()
+		ready, err := s.ready, s.err
+		s.mutex.Unlock()
+
+		if ready {
+			assert.Nil(t, err)
+			break
+		}
+
+		select {
+		case <-timeout:
+			t.Fatal("Expected the stream to be retried")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
 func TestStream_WriteStreamNotReady(t *testing.T) {
 	m := &router.Message{
 		Data: "hello",
@@ -96,15 +337,134 @@ func TestStream_WriteStreamNotReady(t *testing.T) {
 		},
 	}
 
-	s := NewStream("abc", nil, nil)
+	s := NewStream(StreamSpec{Name: "abc"}, nil)
 	s.client = &fakeClient{
 		created: false,
 	}
 	s.Start()
 	err := s.Write(m)
 
-	if assert.Error(t, err, "A stream not ready error was expected") {
-		assert.Equal(t, err, &StreamNotReadyError{Stream: "abc"})
+	assert.Nil(t, err)
+	s.mutex.Lock()
+	assert.Equal(t, 1, s.pending.len())
+	s.mutex.Unlock()
+}
+
+func TestStream_ReplayWithoutLock(t *testing.T) {
+	m := &router.Message{Data: "hello", Container: &docker.Container{ID: "123"}}
+
+	s := NewStream(StreamSpec{Name: "abc"}, nil)
+	s.client = &fakeClient{}
+	assert.Nil(t, s.Write(m))
+
+	// The writer isn't started, so the replay waits for it.
+	s.writers["123"] = newWriter(newBuffer(&Config{}, "abc"), &fakeFlusher{})
+	replayed := make(chan bool)
+	go func() { replayed <- s.replay() }()
+
+	state := make(chan streamState)
+	go func() { state <- s.state() }()
+	select {
+	case st := <-state:
+		assert.False(t, st.ready)
+	case <-time.After(time.Second):
+		t.Fatal("Expected the state not to wait for the replay")
+	}
+
+	// The message goes to a new writer once the busy one is evicted.
+	s.evict("123")
+	select {
+	case ok := <-replayed:
+		assert.True(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("Expected the pending messages to be replayed")
+	}
+	assert.True(t, s.state().ready)
+	assert.Len(t, s.writers, 1)
+	s.stop()
+}
+
+func TestStream_WritePendingOverflow(t *testing.T) {
+	m := &router.Message{
+		Data: "hello",
+		Container: &docker.Container{
+			ID: "123",
+		},
+	}
+
+	s := NewStream(StreamSpec{Name: "abc"}, &Config{PendingLimit: 1})
+
+	assert.Nil(t, s.Write(m))
+	assert.Equal(t, &PendingOverflowError{Stream: "abc", Count: 1}, s.Write(m))
+	assert.Nil(t, s.Write(m))
+
+	// The first message dropped was reported already.
+	messages, dropped := s.pending.drain()
+	assert.Len(t, messages, 1)
+	assert.Equal(t, 1, dropped)
+	assert.Equal(t, int64(2), s.metrics.pendingDropped)
+}
+
+func TestStream_WritePendingDropOldest(t *testing.T) {
+	s := NewStream(StreamSpec{Name: "abc", Backpressure: DropOldest}, &Config{PendingLimit: 1})
+
+	assert.Nil(t, s.Write(&router.Message{Data: "a", Container: &docker.Container{ID: "123"}}))
+	assert.Equal(t, &PendingOverflowError{Stream: "abc", Count: 1},
+		s.Write(&router.Message{Data: "b", Container: &docker.Container{ID: "123"}}))
+
+	messages, dropped := s.pending.drain()
+	assert.Len(t, messages, 1)
+	assert.Equal(t, "b", messages[0].message.Data)
+	assert.Equal(t, 0, dropped)
+	assert.Equal(t, int64(1), s.metrics.pendingDropped)
+}
+
+func TestStream_WritePendingBlock(t *testing.T) {
+	m := &router.Message{Data: "hello", Container: &docker.Container{ID: "123"}}
+
+	s := NewStream(StreamSpec{Name: "abc", Backpressure: Block}, &Config{PendingLimit: 1})
+	s.client = &fakeClient{}
+	assert.Nil(t, s.Write(m))
+
+	written := make(chan error)
+	go func() { written <- s.Write(m) }()
+	select {
+	case <-written:
+		t.Fatal("Expected the write to wait for the stream to be ready")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The snapshots don't wait for the blocked write.
+	assert.Equal(t, 1, s.status("route", "abc").Pending)
+
+	assert.True(t, s.replay())
+	select {
+	case err := <-written:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Expected the write to go on once the stream is ready")
+	}
+	assert.Equal(t, int64(0), s.metrics.pendingDropped)
+	s.stop()
+}
+
+func TestStream_SnapshotWithoutLock(t *testing.T) {
+	s := NewStream(StreamSpec{Name: "abc"}, nil)
+	s.writers["123"] = newWriter(newBuffer(&Config{}, "abc"), &fakeFlusher{})
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.state()
+		s.status("route", "abc")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the snapshots not to wait for the lock")
 	}
 }
 
@@ -120,43 +480,188 @@ func TestStream_WriteStreamBecomesReady(t *testing.T) {
 		},
 	}
 
-	s := NewStream("abc", &tags, tmpl)
+	s := NewStream(StreamSpec{Name: "abc", Tags: &tags}, &Config{PKeyTmpl: tmpl})
 	fk := &fakeClient{
-		created: false,
-		status:  "CREATING",
-		mutex:   sync.Mutex{},
+		created: true,
+		status:  "ACTIVE",
 	}
 	s.client = fk
-	s.Start()
 
+	// The message is queued until the stream is ready.
 	err := s.Write(m)
-	if assert.Error(t, err, "A stream not ready error was expected") {
-		assert.Equal(t, err, &StreamNotReadyError{Stream: "abc"})
-	}
+	assert.Nil(t, err)
 
-	fk.mutex.Lock()
-	fk.status = "ACTIVE"
-	fk.mutex.Unlock()
+	s.Start()
 
-	timeout := make(chan bool)
-	go func() {
-		time.Sleep(1 * time.Second)
-		timeout <- true
-	}()
+	timeout := time.After(time.Second)
 
-	// trying to write until we succeed or timeout
+	// waiting for the queued message to be written
 	for {
-		err = s.Write(m)
-		if err == nil {
+		s.mutex.Lock()
+		_, written := s.writers[m.Container.ID]
+		s.mutex.Unlock()
+
+		if written {
 			break
 		}
 
 		select {
 		case <-timeout:
-			break
-		default:
+			t.Fatal("Expected the queued message to be written")
+		case <-time.After(10 * time.Millisecond):
 		}
 	}
 
-	assert.Nil(t, err)
+	assert.Equal(t, 0, s.pending.len())
+	assert.Nil(t, s.Write(m))
+}
+
+func TestStream_WaitTimeout(t *testing.T) {
+	f := &fakeFlusher{
+		inputs:  make(chan kinesis.PutRecordsInput, 10),
+		flushed: make(chan struct{}),
+	}
+	f.inputs <- *testInput("a")
+
+	s := NewStream(StreamSpec{Name: "abc"}, nil)
+	s.writers["123"] = newWriter(newBuffer(&Config{}, "abc"), f)
+	s.stop()
+
+	timeout := make(chan struct{})
+	close(timeout)
+
+	assert.Equal(t, 1, s.wait(timeout))
+}
+
+func TestStream_WriteStopped(t *testing.T) {
+	m := &router.Message{Data: "hello", Container: &docker.Container{ID: "123"}}
+
+	s := NewStream(StreamSpec{Name: "abc"}, &Config{PendingLimit: 1})
+	s.client = &fakeClient{}
+	assert.Nil(t, s.Write(m))
+	s.stop()
+
+	// The replay after the stop doesn't start writers that would never be
+	// stopped, nor do the writes once ready.
+	assert.False(t, s.replay())
+	s.ready = true
+	s.write(m, nil)
+	assert.Nil(t, s.Write(m))
+	assert.Len(t, s.writers, 0)
+
+	timeout := make(chan struct{})
+	close(timeout)
+
+	assert.Equal(t, 3, s.wait(timeout))
+	assert.Equal(t, int64(2), s.metrics.recordsDropped)
+}
+
+func TestStream_EvictIdle(t *testing.T) {
+	f := &fakeFlusher{
+		inputs:  make(chan kinesis.PutRecordsInput, 10),
+		flushed: make(chan struct{}),
+	}
+
+	s := NewStream(StreamSpec{Name: "abc"}, nil)
+	idle := newWriter(newBuffer(&Config{}, "abc"), f)
+	idle.stats.wrote(time.Now().Add(-time.Hour))
+	go idle.bufferMessages()
+	s.writers["123"] = idle
+
+	active := newWriter(newBuffer(&Config{}, "abc"), f)
+	s.writers["456"] = active
+
+	s.evictIdle(time.Minute)
+
+	_, ok := s.writers["123"]
+	assert.False(t, ok, "Expected the idle writer to be evicted")
+	_, ok = s.writers["456"]
+	assert.True(t, ok, "Expected the active writer to be kept")
+
+	select {
+	case _, ok := <-f.inputs:
+		assert.False(t, ok, "Expected the flusher to be stopped")
+	case <-time.After(time.Second):
+		t.Fatal("Expected the flusher to be stopped")
+	}
+}
+
+func TestStream_EvictOnContainerExit(t *testing.T) {
+	exits := containerExits.subscribe()
+	defer containerExits.unsubscribe(exits)
+
+	containerExits.publish("123")
+
+	s := NewStream(StreamSpec{Name: "abc"}, nil)
+	s.writers["123"] = newWriter(newBuffer(&Config{}, "abc"), &fakeFlusher{})
+
+	select {
+	case id := <-exits:
+		s.evict(id)
+	case <-time.After(time.Second):
+		t.Fatal("Expected the container exit to be published")
+	}
+
+	assert.Len(t, s.writers, 0)
+	assert.Len(t, s.retired, 1)
+}
+
+func TestStream_EvictPrunesRetired(t *testing.T) {
+	// Without an idle timeout, the writers are only evicted on exit.
+	s := NewStream(StreamSpec{Name: "abc"}, nil)
+	sent := &fakeFlusher{inputs: make(chan kinesis.PutRecordsInput), flushed: make(chan struct{})}
+	s.writers["123"] = newWriter(newBuffer(&Config{}, "abc"), sent)
+	sending := &fakeFlusher{}
+	s.writers["456"] = newWriter(newBuffer(&Config{}, "abc"), sending)
+
+	s.evict("123")
+	assert.Len(t, s.retired, 1)
+
+	close(sent.flushed)
+	s.evict("456")
+	assert.Len(t, s.retired, 1)
+	assert.True(t, s.retired[0].flusher == sending)
+}
+
+func TestStream_Encrypt(t *testing.T) {
+	s := NewStream(StreamSpec{Name: "abc", KMSKeyID: "alias/logs"}, nil)
+	client := &fakeClient{status: "ACTIVE", encryption: "NONE"}
+	s.client = client
+
+	assert.Nil(t, s.encrypt())
+	assert.Equal(t, "alias/logs", client.encrypted)
+}
+
+func TestStream_EncryptAlreadyEncrypted(t *testing.T) {
+	s := NewStream(StreamSpec{Name: "abc", KMSKeyID: "alias/logs"}, &Config{RequireEncryption: true})
+	client := &fakeClient{status: "ACTIVE", encryption: "KMS", keyID: "arn:aws:kms:us-east-1:123456789012:alias/logs"}
+	s.client = client
+
+	assert.Nil(t, s.encrypt())
+	assert.Equal(t, "", client.encrypted)
+}
+
+func TestStream_EncryptionRequiredKey(t *testing.T) {
+	s := NewStream(StreamSpec{Name: "abc", KMSKeyID: "alias/logs"}, &Config{RequireEncryption: true})
+	s.client = &fakeClient{status: "ACTIVE", encryption: "KMS", keyID: "alias/aws/kinesis"}
+
+	assert.Equal(t, &StreamKeyError{Stream: "abc", KeyID: "alias/aws/kinesis", Expected: "alias/logs"}, s.encrypt())
+
+	assert.True(t, sameKMSKey("arn:aws:kms:us-east-1:123456789012:key/1234abcd", "1234abcd"))
+	assert.False(t, sameKMSKey("arn:aws:kms:us-east-1:123456789012:key/1234abcd", "alias/logs"))
+
+	// Any key is accepted without a configured one.
+	s = NewStream(StreamSpec{Name: "abc"}, &Config{RequireEncryption: true})
+	s.client = &fakeClient{status: "ACTIVE", encryption: "KMS", keyID: "alias/aws/kinesis"}
+	assert.Nil(t, s.encrypt())
+}
+
+func TestStream_EncryptionRequired(t *testing.T) {
+	s := NewStream(StreamSpec{Name: "abc", KMSKeyID: "alias/logs"}, &Config{SkipCreate: true, RequireEncryption: true})
+	client := &fakeClient{status: "ACTIVE", encryption: "NONE"}
+	s.client = client
+
+	err := s.encrypt()
+	assert.IsType(t, &StreamEncryptionError{}, err)
+	assert.Equal(t, "", client.encrypted, "The streams managed elsewhere aren't encrypted")
 }
@@ -0,0 +1,144 @@
+package kinesis
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/gliderlabs/logspout/router"
+)
+
+// TagsPerRequest is the maximum number of tags added by a single
+// AddTagsToStream request.
+const TagsPerRequest = 10
+
+// InvalidTagError is returned when a tag of KINESIS_STREAM_TAGS isn't a
+// key=template pair.
+type InvalidTagError struct {
+	Tag string
+}
+
+func (e *InvalidTagError) Error() string {
+	return fmt.Sprintf("invalid tag: %q, expected key=template in KINESIS_STREAM_TAGS", e.Tag)
+}
+
+// compileTagTmpls compiles the tag value templates, from the
+// KINESIS_STREAM_TAGS list and the KINESIS_STREAM_TAG_KEY and
+// KINESIS_STREAM_TAG_VALUE pair.
+func compileTagTmpls(route *router.Route) (map[string]*template.Template, error) {
+	options, err := tmplOptions(route)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpls, err := parseTagTmpls(routeOpt(route, "KINESIS_STREAM_TAGS"), options...)
+	if err != nil {
+		return nil, err
+	}
+
+	key, value := routeOpt(route, "KINESIS_STREAM_TAG_KEY"), routeOpt(route, "KINESIS_STREAM_TAG_VALUE")
+	if key != "" || value != "" {
+		if key == "" {
+			return nil, ErrMissingTagKey
+		}
+
+		tmpl, err := compileTmpl(route, "KINESIS_STREAM_TAG_VALUE")
+		if err != nil {
+			return nil, err
+		}
+		tmpls[key] = tmpl
+	}
+
+	if len(tmpls) == 0 {
+		return nil, &MissingEnvVarError{EnvVar: "KINESIS_STREAM_TAGS"}
+	}
+
+	return tmpls, nil
+}
+
+// parseTagTmpls parses a list of key=template pairs separated by
+// semicolons, e.g. "team=infra;app={{ label .Container "app" }}".
+func parseTagTmpls(s string, options ...string) (map[string]*template.Template, error) {
+	return parseKeyTmpls(s, func(tag string) error {
+		return &InvalidTagError{Tag: tag}
+	}, options...)
+}
+
+// parseKeyTmpls parses a list of key=template pairs separated by
+// semicolons, returning the error of invalid for a pair without a key.
+func parseKeyTmpls(s string, invalid func(pair string) error, options ...string) (map[string]*template.Template, error) {
+	tmpls := make(map[string]*template.Template)
+
+	for _, pair := range strings.Split(s, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" {
+			return nil, invalid(pair)
+		}
+
+		tmpl, err := parseTmpl(strings.TrimSpace(parts[1]), options...)
+		if err != nil {
+			return nil, err
+		}
+		tmpls[key] = tmpl
+	}
+
+	return tmpls, nil
+}
+
+// streamTags renders the tag values from the message, the tags with an empty
+// value are skipped, except the required one.
+func streamTags(tmpls map[string]*template.Template, required string, m *router.Message, debug debugLogger) (*map[string]*string, error) {
+	tags := make(map[string]*string, len(tmpls))
+
+	for key, tmpl := range tmpls {
+		value, err := executeTmpl(tmpl, m)
+		if err != nil {
+			return nil, err
+		}
+
+		if value == "" && key == required {
+			return nil, ErrMissingTagValue
+		}
+		if value == "" {
+			debug.printf("the tag value is empty, skipping the tag: %s", key)
+			continue
+		}
+		tags[key] = aws.String(value)
+	}
+
+	return &tags, nil
+}
+
+// tagBatches splits the tags into batches of at most TagsPerRequest tags,
+// sorted by key.
+func tagBatches(tags map[string]*string) []map[string]*string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var batches []map[string]*string
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > TagsPerRequest {
+			n = TagsPerRequest
+		}
+
+		batch := make(map[string]*string, n)
+		for _, key := range keys[:n] {
+			batch[key] = tags[key]
+		}
+		batches = append(batches, batch)
+		keys = keys[n:]
+	}
+
+	return batches
+}
@@ -0,0 +1,107 @@
+package kinesis
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+	"github.com/stretchr/testify/assert"
+)
+
+type tagClient struct {
+	fakeClient
+	inputs []*kinesis.AddTagsToStreamInput
+}
+
+func (c *tagClient) Tag(input *kinesis.AddTagsToStreamInput) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.inputs = append(c.inputs, input)
+	return nil
+}
+
+func TestParseTagTmpls(t *testing.T) {
+	tmpls, err := parseTagTmpls(`team=infra; app={{ label .Container "app" }};;`)
+	assert.Nil(t, err)
+	assert.Len(t, tmpls, 2)
+
+	_, err = parseTagTmpls("team")
+	assert.IsType(t, &InvalidTagError{}, err)
+
+	_, err = parseTagTmpls("=infra")
+	assert.IsType(t, &InvalidTagError{}, err)
+}
+
+func TestCompileTagTmpls(t *testing.T) {
+	defer os.Unsetenv("KINESIS_STREAM_TAGS")
+	defer os.Unsetenv("KINESIS_STREAM_TAG_KEY")
+	defer os.Unsetenv("KINESIS_STREAM_TAG_VALUE")
+
+	_, err := compileTagTmpls(nil)
+	assert.IsType(t, &MissingEnvVarError{}, err)
+
+	os.Setenv("KINESIS_STREAM_TAG_VALUE", "abc")
+	_, err = compileTagTmpls(nil)
+	assert.Equal(t, ErrMissingTagKey, err)
+
+	os.Unsetenv("KINESIS_STREAM_TAG_VALUE")
+	os.Setenv("KINESIS_STREAM_TAG_KEY", "app")
+	_, err = compileTagTmpls(nil)
+	assert.Equal(t, &MissingEnvVarError{EnvVar: "KINESIS_STREAM_TAG_VALUE"}, err)
+
+	os.Setenv("KINESIS_STREAM_TAG_VALUE", "abc")
+	os.Setenv("KINESIS_STREAM_TAGS", "team=infra")
+	tmpls, err := compileTagTmpls(nil)
+	assert.Nil(t, err)
+	assert.Len(t, tmpls, 2)
+}
+
+func TestStreamTags(t *testing.T) {
+	tmpls, _ := parseTagTmpls(`team=infra;app={{ label .Container "app" }}`)
+	m := &router.Message{Container: &docker.Container{Config: &docker.Config{}}}
+
+	tags, err := streamTags(tmpls, "", m, false)
+	assert.Nil(t, err)
+	assert.Len(t, *tags, 1)
+	assert.Equal(t, "infra", aws.StringValue((*tags)["team"]))
+
+	_, err = streamTags(tmpls, "app", m, false)
+	assert.Equal(t, ErrMissingTagValue, err)
+}
+
+func TestStream_TagBatches(t *testing.T) {
+	tags := make(map[string]*string)
+	for i := 0; i < 25; i++ {
+		tags[fmt.Sprintf("tag%02d", i)] = aws.String("abc")
+	}
+
+	s := NewStream(StreamSpec{Name: "abc", Tags: &tags}, nil)
+	client := &tagClient{}
+	s.client = client
+
+	assert.Nil(t, s.tag())
+	assert.Len(t, client.inputs, 3)
+	assert.Len(t, client.inputs[0].Tags, 10)
+	assert.Len(t, client.inputs[2].Tags, 5)
+}
+
+func TestStream_SkipRetag(t *testing.T) {
+	tags := map[string]*string{"app": aws.String("abc")}
+
+	s := NewStream(StreamSpec{Name: "abc", Tags: &tags}, &Config{SkipRetag: true})
+	client := &tagClient{fakeClient: fakeClient{created: true, status: "ACTIVE"}}
+	s.client = client
+	assert.Nil(t, s.setup())
+	assert.Len(t, client.inputs, 0)
+
+	s = NewStream(StreamSpec{Name: "abc", Tags: &tags}, &Config{SkipRetag: true})
+	client = &tagClient{fakeClient: fakeClient{status: "ACTIVE"}}
+	s.client = client
+	assert.Nil(t, s.setup())
+	assert.Len(t, client.inputs, 1)
+}
@@ -2,17 +2,28 @@ package kinesis
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
 	"strings"
 	"text/template"
+	"time"
 
+	"github.com/fsouza/go-dockerclient"
 	"github.com/gliderlabs/logspout/router"
 )
 
 var funcMap = template.FuncMap{
-	"lookUp": lookUp,
+	"lookUp":     lookUp,
+	"json":       toJSON,
+	"timeFormat": timeFormat,
+	"label":      label,
+}
+
+// strictFuncMap overrides the functions of the templates with the
+// missingkey=error policy, failing on a missing label.
+var strictFuncMap = template.FuncMap{
+	"label": strictLabel,
 }
 
 // ErrEmptyTmpl is returned when the template is empty.
@@ -24,16 +35,78 @@ type MissingEnvVarError struct {
 }
 
 func (e *MissingEnvVarError) Error() string {
-	return fmt.Sprintf("missing required %s environment variable", e.EnvVar)
+	return fmt.Sprintf("missing required %s environment variable or %s route option", e.EnvVar, optionName(e.EnvVar))
+}
+
+// UnknownMissingKeyError is returned when the missingkey policy of the
+// templates isn't supported.
+type UnknownMissingKeyError struct {
+	MissingKey string
 }
 
-func compileTmpl(envVar string) (*template.Template, error) {
-	tmplString := os.Getenv(envVar)
+func (e *UnknownMissingKeyError) Error() string {
+	return fmt.Sprintf("unknown missingkey policy: %s, expected default, zero or error", e.MissingKey)
+}
+
+// TemplateError is returned when the templates of a message couldn't be
+// rendered.
+type TemplateError struct {
+	Container string
+	// Fallback is the stream the message is written to instead, if any.
+	Fallback string
+	// Suppressed counts the errors that weren't reported since the last one.
+	Suppressed int
+	Err        error
+}
+
+func (e *TemplateError) Error() string {
+	action := "skipping the message"
+	if e.Fallback != "" {
+		action = "sending the message to the fallback stream: " + e.Fallback
+	}
+
+	return fmt.Sprintf("couldn't render the templates, %s. container: %s, # suppressed: %d, %s",
+		action, e.Container, e.Suppressed, e.Err)
+}
+
+// compileTmpl compiles the template of the route option or the environment
+// variable.
+func compileTmpl(route *router.Route, envVar string) (*template.Template, error) {
+	tmplString := routeOpt(route, envVar)
 	if tmplString == "" {
 		return nil, &MissingEnvVarError{EnvVar: envVar}
 	}
 
-	tmpl, err := template.New("").Funcs(funcMap).Parse(tmplString)
+	options, err := tmplOptions(route)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseTmpl(tmplString, options...)
+}
+
+// tmplOptions returns the options of the route templates, i.e. the
+// missingkey policy of KINESIS_TEMPLATE_MISSINGKEY.
+func tmplOptions(route *router.Route) ([]string, error) {
+	switch missingKey := routeOpt(route, "KINESIS_TEMPLATE_MISSINGKEY"); missingKey {
+	case "":
+		return nil, nil
+	case "default", "zero", "error":
+		return []string{"missingkey=" + missingKey}, nil
+	default:
+		return nil, &UnknownMissingKeyError{MissingKey: missingKey}
+	}
+}
+
+func parseTmpl(tmplString string, options ...string) (*template.Template, error) {
+	tmpl := template.New("").Funcs(funcMap)
+	for _, option := range options {
+		if option == "missingkey=error" {
+			tmpl = tmpl.Funcs(strictFuncMap)
+		}
+	}
+
+	tmpl, err := tmpl.Option(options...).Parse(tmplString)
 	if err != nil {
 		return nil, err
 	}
@@ -66,3 +139,61 @@ func lookUp(arr []string, key string) string {
 	}
 	return ""
 }
+
+// toJSON encodes the value as JSON, e.g. a quoted and escaped string.
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// timeFormat formats the time with the given layout, see time.Format.
+func timeFormat(t time.Time, layout string) string {
+	return t.Format(layout)
+}
+
+// reportTemplateError reports the error of a message whose templates couldn't
+// be rendered, outside of an adapter.
+func reportTemplateError(m *router.Message, err error) {
+	ErrorHandler(&TemplateError{Container: m.Container.ID, Err: err})
+}
+
+// label returns the value of the container label, or an empty string
+// if the container doesn't have it.
+func label(c *docker.Container, key string) string {
+	if c == nil || c.Config == nil {
+		return ""
+	}
+	return c.Config.Labels[key]
+}
+
+// strictLabel returns the value of the container label, or an error if the
+// container doesn't have it.
+func strictLabel(c *docker.Container, key string) (string, error) {
+	if c == nil || c.Config == nil {
+		return "", fmt.Errorf("missing label: %s", key)
+	}
+
+	value, ok := c.Config.Labels[key]
+	if !ok {
+		return "", fmt.Errorf("missing label: %s", key)
+	}
+	return value, nil
+}
+
+// executeOptTmpl renders an optional template, returning an empty string if
+// it's not set.
+func executeOptTmpl(tmpl *template.Template, m *router.Message) (string, error) {
+	if tmpl == nil {
+		return "", nil
+	}
+
+	value, err := executeTmpl(tmpl, m)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(value), nil
+}
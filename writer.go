@@ -1,25 +1,88 @@
 package kinesis
 
 import (
+	"sync"
 	"time"
 
 	"github.com/gliderlabs/logspout/router"
 )
 
+// writerStats is the fill level of the buffer of a writer, and the time of
+// its last write, read by the status API.
+type writerStats struct {
+	mutex     sync.Mutex
+	records   int
+	bytes     int
+	lastWrite time.Time
+}
+
+func (s *writerStats) set(records, bytes int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.records = records
+	s.bytes = bytes
+}
+
+func (s *writerStats) flushed() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.records = 0
+	s.bytes = 0
+}
+
+func (s *writerStats) get() (records, bytes int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.records, s.bytes
+}
+
+func (s *writerStats) wrote(t time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastWrite = t
+}
+
+func (s *writerStats) written() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.lastWrite
+}
+
 type writer struct {
 	buffer   *buffer
 	flusher  Flusher
 	messages chan *router.Message
+	clock    *time.Ticker
 	ticker   <-chan time.Time
+	quit     chan struct{}
+	flushes  chan struct{}
+	stats    writerStats
+	metrics  *streamMetrics
+	// templateError handles the messages whose templates couldn't be
+	// rendered.
+	templateError func(m *router.Message, err error)
 }
 
 func newWriter(b *buffer, f Flusher) *writer {
+	clock := time.NewTicker(time.Second)
+
 	w := &writer{
 		messages: make(chan *router.Message),
-		ticker:   time.NewTicker(time.Second).C,
+		clock:    clock,
+		ticker:   clock.C,
+		quit:     make(chan struct{}),
+		flushes:  make(chan struct{}, 1),
 		flusher:  f,
 		buffer:   b,
+
+		templateError: reportTemplateError,
 	}
+	w.stats.wrote(time.Now())
 
 	return w
 }
@@ -29,12 +92,38 @@ func (w *writer) start() {
 	go w.bufferMessages()
 }
 
-func (w *writer) write(m *router.Message) {
-	w.messages <- m
+// write sends the message to the buffer. It returns false if the writer was
+// stopped before the message was buffered.
+func (w *writer) write(m *router.Message) bool {
+	select {
+	case w.messages <- m:
+		return true
+	case <-w.quit:
+		return false
+	}
+}
+
+// requestFlush asks the writer to flush its buffer without waiting for the
+// ticker.
+func (w *writer) requestFlush() {
+	select {
+	case w.flushes <- struct{}{}:
+	default:
+	}
+}
+
+// stop flushes the buffer and stops the flusher, once the messages written
+// so far are buffered.
+func (w *writer) stop() {
+	close(w.quit)
 }
 
 func (w *writer) bufferMessages() {
+	defer w.clock.Stop()
+
 	flush := func() {
+		w.buffer.seal()
+		w.stats.flushed()
 		w.flusher.flush(*w.buffer.input)
 		w.buffer.reset()
 	}
@@ -42,17 +131,43 @@ func (w *writer) bufferMessages() {
 	for {
 		select {
 		case m := <-w.messages:
-			if w.buffer.full(m) {
+			e, err := w.buffer.entry(m)
+			if te, ok := err.(*TemplateError); ok {
+				w.templateError(m, te.Err)
+				continue
+			}
+			if err != nil {
+				if err == ErrRecordTooBig {
+					w.metrics.tooBig()
+				}
+				ErrorHandler(err)
+				continue
+			}
+
+			if w.buffer.full(e) {
 				flush()
 			}
 
-			ErrorHandler(w.buffer.add(m))
+			w.buffer.add(e)
+			w.stats.set(w.buffer.fill())
+			w.metrics.buffered(1, entrySize(e))
+		case <-w.flushes:
+			if !w.buffer.empty() {
+				flush()
+			}
 		case <-w.ticker:
 			if !w.buffer.empty() {
 				flush()
 			} else {
-				debug("buffer is empty, stream: %s", *w.buffer.input.StreamName)
+				w.buffer.debug.printf("buffer is empty, stream: %s", *w.buffer.input.StreamName)
 			}
+		case <-w.quit:
+			if !w.buffer.empty() {
+				flush()
+			}
+
+			w.flusher.stop()
+			return
 		}
 	}
 }
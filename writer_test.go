@@ -8,6 +8,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/fsouza/go-dockerclient"
 	"github.com/gliderlabs/logspout/router"
+	"github.com/stretchr/testify/assert"
 )
 
 type fakeFlusher struct {
@@ -38,6 +39,30 @@ func (f *fakeFlusher) flushInputs() {
 	}
 }
 
+func (f *fakeFlusher) stop() {
+	close(f.inputs)
+}
+
+func (f *fakeFlusher) done() <-chan struct{} {
+	return f.flushed
+}
+
+func (f *fakeFlusher) pending() int {
+	return len(f.inputs)
+}
+
+func (f *fakeFlusher) queued() int {
+	return len(f.inputs)
+}
+
+func (f *fakeFlusher) lastError() error {
+	return nil
+}
+
+func (f *fakeFlusher) lastFlush() time.Time {
+	return time.Time{}
+}
+
 var testLimits = limits{
 	putRecords:     2,
 	putRecordsSize: PutRecordsSizeLimit,
@@ -46,7 +71,7 @@ var testLimits = limits{
 
 func TestWriter_Flush(t *testing.T) {
 	tmpl, _ := template.New("").Parse("abc")
-	b := newBuffer(tmpl, "abc")
+	b := newBuffer(&Config{PKeyTmpl: tmpl}, "abc")
 	b.limits = &testLimits
 
 	f := &fakeFlusher{
@@ -79,7 +104,7 @@ func TestWriter_Flush(t *testing.T) {
 
 func TestWriter_PeriodicFlush(t *testing.T) {
 	tmpl, _ := template.New("").Parse("abc")
-	b := newBuffer(tmpl, "abc")
+	b := newBuffer(&Config{PKeyTmpl: tmpl}, "abc")
 	b.limits = &testLimits
 
 	f := &fakeFlusher{
@@ -114,3 +139,44 @@ func TestWriter_PeriodicFlush(t *testing.T) {
 		t.Fatal("Expected flush to be called")
 	}
 }
+
+func TestWriter_StopFlushes(t *testing.T) {
+	tmpl, _ := template.New("").Parse("abc")
+	b := newBuffer(&Config{PKeyTmpl: tmpl}, "abc")
+
+	f := &fakeFlusher{
+		inputs:    make(chan kinesis.PutRecordsInput, 10),
+		flushFunc: func() {},
+	}
+
+	w := newWriter(b, f)
+	w.ticker = nil
+
+	stopped := make(chan struct{})
+	go func() {
+		w.bufferMessages()
+		close(stopped)
+	}()
+
+	m := &router.Message{
+		Data: "hello",
+		Container: &docker.Container{
+			ID: "123",
+		},
+	}
+	w.write(m)
+	w.stop()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the writer to stop")
+	}
+
+	inp, ok := <-f.inputs
+	if assert.True(t, ok, "Expected the buffer to be flushed") {
+		assert.Len(t, inp.Records, 1)
+	}
+	_, ok = <-f.inputs
+	assert.False(t, ok, "Expected the flusher to be stopped")
+}